@@ -32,3 +32,129 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrCorruptRecord struct {
+	Offset uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.DataLoss,
+		fmt.Sprintf("corrupt record: %d", e.Offset),
+	)
+	msg := fmt.Sprintf("The record stored at offset %d failed its checksum", e.Offset)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOffsetCompacted struct {
+	Offset uint64
+}
+
+func (e ErrOffsetCompacted) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("offset compacted: %d", e.Offset),
+	)
+	msg := fmt.Sprintf("The record at offset %d was removed by compaction", e.Offset)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOffsetCompacted) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("topic not found: %s", e.Topic),
+	)
+	msg := fmt.Sprintf("The requested topic doesn't exist: %s", e.Topic)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidTopic struct {
+	Topic string
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("invalid topic: %q", e.Topic),
+	)
+	msg := fmt.Sprintf("Topic names are 1 to 249 letters, digits, '.', '_' or '-', got: %q", e.Topic)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrPartitionNotFound struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrPartitionNotFound) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.NotFound,
+		fmt.Sprintf("partition not found: %s/%d", e.Topic, e.Partition),
+	)
+	msg := fmt.Sprintf("Topic %s has no partition %d", e.Topic, e.Partition)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrPartitionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -9,6 +9,7 @@ import (
 	"proglog/internal/log"
 	"proglog/internal/server"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -28,12 +29,22 @@ type Config struct {
 	StartJoinAddrs []string
 	ACLModelFile   string
 	ACLPolicyFile  string
+	// retention limits for the log, a zero limit is not enforced.
+	RetentionMaxBytes uint64
+	RetentionMaxAge   time.Duration
+	// number of partitions new topics are created with, 0 for 1
+	Partitions uint32
+	// file of keys to encrypt segments with, in the format log.KeyFile
+	// reads. empty to leave segments in plaintext.
+	KeyFile string
+	// config of specific topics, others get a config with the limits above
+	TopicConfigs map[string]log.Config
 }
 
 type Agent struct {
 	Config
 
-	log        *log.Log
+	log        *log.Manager
 	server     *grpc.Server
 	membership *discovery.Membership
 	replicator *log.Replicator
@@ -81,9 +92,17 @@ func (a *Agent) setupLogger() error {
 
 func (a *Agent) setupLog() error {
 	var err error
-	a.log, err = log.NewLog(
+	logConfig := log.Config{}
+	logConfig.Retention.MaxBytes = a.Config.RetentionMaxBytes
+	logConfig.Retention.MaxAge = a.Config.RetentionMaxAge
+	logConfig.Partitions = a.Config.Partitions
+	if a.Config.KeyFile != "" {
+		logConfig.Segment.Keys = log.KeyFile{Path: a.Config.KeyFile}
+	}
+	a.log, err = log.NewManager(
 		a.Config.DataDir,
-		log.Config{},
+		logConfig,
+		a.Config.TopicConfigs,
 	)
 	return err
 }
@@ -94,7 +113,7 @@ func (a *Agent) setupServer() error {
 		a.Config.ACLPolicyFile,
 	)
 	serverConfig := &server.Config{
-		CommitLog:  a.log,
+		Topics:     server.NewTopicManager(a.log),
 		Authorizer: authorizer,
 	}
 	var opts []grpc.ServerOption
@@ -0,0 +1,133 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compresses records as they're written to the store. each record's
+// header carries the ID of the codec it was written with, so a segment
+// can hold records written with different codecs.
+type Codec interface {
+	// identifies the codec in record headers. 0 means uncompressed.
+	ID() uint8
+	Compress(p []byte) ([]byte, error)
+	Decompress(p []byte) ([]byte, error)
+}
+
+var (
+	Gzip   Codec = gzipCodec{}
+	Snappy Codec = snappyCodec{}
+	Zstd   Codec = &zstdCodec{}
+
+	codecsMu sync.RWMutex
+	// codecs records can be read with, by ID
+	codecs = map[uint8]Codec{
+		Gzip.ID():   Gzip,
+		Snappy.ID(): Snappy,
+		Zstd.ID():   Zstd,
+	}
+)
+
+// makes a codec available for reading and writing records. codecs must be
+// registered before opening logs whose records were written with them.
+func RegisterCodec(c Codec) error {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if c.ID() == 0 {
+		return fmt.Errorf("codec id 0 is reserved for uncompressed records")
+	}
+	if _, ok := codecs[c.ID()]; ok {
+		return fmt.Errorf("codec id %d already registered", c.ID())
+	}
+	codecs[c.ID()] = c
+	return nil
+}
+
+func codecByID(id uint8) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec: %d", id)
+	}
+	return c, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() uint8 { return 1 }
+
+func (gzipCodec) Compress(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(p []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() uint8 { return 2 }
+
+func (snappyCodec) Compress(p []byte) ([]byte, error) {
+	return snappy.Encode(nil, p), nil
+}
+
+func (snappyCodec) Decompress(p []byte) ([]byte, error) {
+	return snappy.Decode(nil, p)
+}
+
+// the encoder and decoder are safe to share and costly to create,
+// so they're made once on first use
+type zstdCodec struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+}
+
+func (*zstdCodec) ID() uint8 { return 3 }
+
+func (z *zstdCodec) init() error {
+	z.once.Do(func() {
+		if z.enc, z.err = zstd.NewWriter(nil); z.err != nil {
+			return
+		}
+		z.dec, z.err = zstd.NewReader(nil)
+	})
+	return z.err
+}
+
+func (z *zstdCodec) Compress(p []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.enc.EncodeAll(p, nil), nil
+}
+
+func (z *zstdCodec) Decompress(p []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.dec.DecodeAll(p, nil)
+}
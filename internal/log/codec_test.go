@@ -0,0 +1,134 @@
+package log
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCodecs(t *testing.T) {
+	for scenario, c := range map[string]Codec{
+		"gzip":   Gzip,
+		"snappy": Snappy,
+		"zstd":   Zstd,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			p := []byte(`{"hello": "world", "hello again": "world"}`)
+			b, err := c.Compress(p)
+			require.NoError(t, err)
+			got, err := c.Decompress(b)
+			require.NoError(t, err)
+			require.Equal(t, p, got)
+
+			registered, err := codecByID(c.ID())
+			require.NoError(t, err)
+			require.Equal(t, c, registered)
+		})
+	}
+	require.Error(t, RegisterCodec(Gzip))
+	_, err := codecByID(42)
+	require.Error(t, err)
+}
+
+func TestCompressedSegments(t *testing.T) {
+	dir, err := os.MkdirTemp("", "codec-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte(`{"hello": "world", "hello": "world", "hello": "world"}`)}
+	c := Config{}
+	c.Segment.Codec = Gzip
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(want)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// records written with other codecs stay readable
+	for _, codec := range []Codec{Zstd, nil, Snappy} {
+		c.Segment.Codec = codec
+		log, err = NewLog(dir, c)
+		require.NoError(t, err)
+		_, err = log.Append(want)
+		require.NoError(t, err)
+		require.NoError(t, log.Close())
+	}
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for offset := uint64(0); offset < 4; offset++ {
+		read, err := log.Read(offset)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, read.Value)
+	}
+
+	// the reader hands out records uncompressed
+	b, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+	for offset := uint64(0); offset < 4; offset++ {
+		require.Equal(t, uint8(0), b[0])
+		size := enc.Uint64(b[:lenWidth])
+		read := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[headerWidth:headerWidth+size], read))
+		require.Equal(t, want.Value, read.Value)
+		require.Equal(t, offset, read.Offset)
+		b = b[headerWidth+size:]
+	}
+	require.Empty(t, b)
+}
+
+func TestCorruptCodecID(t *testing.T) {
+	dir, err := os.MkdirTemp("", "codec-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.Codec = Gzip
+	// a sealed segment, which isn't recovered on open
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	var positions []uint64
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		_, pos, err := log.segments[0].index.Read(int64(i))
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	require.NoError(t, log.Close())
+
+	// the codec ID isn't checksummed, so flipping it leaves the records
+	// matching their checksums but no longer decodable. the store keeps
+	// its mtime, as a flipped bit would, so the index isn't rebuilt.
+	store := path.Join(dir, "0.store")
+	fi, err := os.Stat(store)
+	require.NoError(t, err)
+	f, err := os.OpenFile(store, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	for i, id := range []byte{Zstd.ID(), 42} {
+		_, err = f.WriteAt([]byte{id}, int64(positions[i+1]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Chtimes(store, fi.ModTime(), fi.ModTime()))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for offset := uint64(1); offset < 3; offset++ {
+		_, err = log.Read(offset)
+		require.Equal(t, api.ErrCorruptRecord{Offset: offset}, err)
+		_, err = log.Iterator(offset).Next()
+		require.Equal(t, api.ErrCorruptRecord{Offset: offset}, err)
+	}
+	_, err = io.ReadAll(log.Reader())
+	require.Equal(t, api.ErrCorruptRecord{Offset: 1}, err)
+}
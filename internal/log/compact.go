@@ -0,0 +1,195 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"time"
+
+	api "proglog/api/v1"
+
+	"go.uber.org/zap"
+)
+
+// directory in the log's dir that segments are rewritten in
+const compactDir = "compact"
+
+// rewrites sealed segments to keep only the newest record per key and
+// returns the number of records removed. records without a key are always
+// kept, and tombstones are kept until they're older than the tombstone
+// retention. offsets don't change, so reading a removed record returns
+// api.ErrOffsetCompacted. the log is only locked to swap each rewritten
+// segment in, so reads and appends carry on while it runs.
+func (l *Log) Compact() (uint64, error) {
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
+	// TruncateAfter changes sealed segments in place, so it waits too
+	l.snapshots.RLock()
+	defer l.snapshots.RUnlock()
+	segments, next := l.acquireSegments()
+	defer func() {
+		for _, s := range segments {
+			s.release()
+		}
+	}()
+	// find the newest offset of every key, including in the active segment
+	newest := make(map[string]uint64)
+	note := func(record *api.Record) error {
+		if len(record.Key) != 0 {
+			newest[string(record.Key)] = record.Offset
+		}
+		return nil
+	}
+	sealed, active := segments[:len(segments)-1], segments[len(segments)-1]
+	for _, s := range sealed {
+		if err := s.scan(note); err != nil {
+			return 0, err
+		}
+	}
+	// the active segment is read a record at a time under the lock, as
+	// appends change it
+	for offset := active.baseOffset; offset < next; offset++ {
+		l.mu.RLock()
+		record, err := active.Read(offset)
+		l.mu.RUnlock()
+		// a failed batch cut it back
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		note(record)
+	}
+	expiry := time.Now().Add(-l.Config.Compaction.TombstoneRetention).UnixNano()
+	var removed uint64
+	for _, s := range sealed {
+		// rewriting a damaged segment would lose the records past the
+		// one that can't be read
+		if s.damaged {
+			continue
+		}
+		var keep []*api.Record
+		var dropped uint64
+		if err := s.scan(func(record *api.Record) error {
+			switch {
+			case len(record.Key) == 0:
+			case newest[string(record.Key)] != record.Offset:
+				dropped++
+				return nil
+			case len(record.Value) == 0 && record.Timestamp < expiry:
+				dropped++
+				return nil
+			}
+			keep = append(keep, record)
+			return nil
+		}); err != nil {
+			return removed, err
+		}
+		if dropped == 0 {
+			continue
+		}
+		swapped, err := l.rewriteSegment(s, keep)
+		if err != nil {
+			return removed, err
+		}
+		if swapped {
+			removed += dropped
+		}
+	}
+	return removed, nil
+}
+
+// references the log's segments, so they stay open while they're read
+// outside the lock, and returns them with the active segment's next offset
+func (l *Log) acquireSegments() ([]*segment, uint64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	segments := append([]*segment(nil), l.segments...)
+	for _, s := range segments {
+		s.acquire()
+	}
+	return segments, l.activeSegment.nextOffset
+}
+
+// replaces old with a segment holding only the given records, reporting
+// whether old was still in the log to be replaced
+func (l *Log) rewriteSegment(old *segment, records []*api.Record) (bool, error) {
+	fs := l.Config.fs()
+	dir := path.Join(l.Dir, compactDir)
+	// clear out anything left by a crashed compaction
+	if err := fs.RemoveAll(dir); err != nil {
+		return false, err
+	}
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+	defer fs.RemoveAll(dir)
+	s, err := newSegment(dir, old.baseOffset, l.Config)
+	if err != nil {
+		return false, err
+	}
+	for _, record := range records {
+		if err = s.write(record); err != nil {
+			s.Close()
+			return false, err
+		}
+	}
+	if err = s.Close(); err != nil {
+		return false, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// retention may have removed the segment in the meantime
+	i := slices.Index(l.segments, old)
+	if i == -1 {
+		return false, nil
+	}
+	// the store and indexes can't be replaced at once, and an index left
+	// behind by a crash isn't necessarily older than the store, so the
+	// manifest marks the segment until its files are all replaced
+	m := l.manifest()
+	m.Compacting = &old.baseOffset
+	if err = writeManifest(fs, l.Dir, m); err != nil {
+		return false, err
+	}
+	// the old segment's open files still hold its records, so it serves
+	// reads until the new one is in place
+	for _, ext := range []string{".store", ".index", ".timeindex"} {
+		name := fmt.Sprintf("%d%s", old.baseOffset, ext)
+		if err = fs.Rename(path.Join(dir, name), path.Join(l.Dir, name)); err != nil {
+			return false, err
+		}
+	}
+	if s, err = newSegment(l.Dir, old.baseOffset, l.Config); err != nil {
+		return false, err
+	}
+	// the segment's newest records may be gone, but not their offsets
+	s.nextOffset = old.nextOffset
+	if err = s.store.Seal(); err != nil {
+		s.Close()
+		return false, err
+	}
+	l.segments[i] = s
+	// readers still reading the old segment keep it open
+	if err = old.retire(); err != nil {
+		return true, err
+	}
+	return true, l.saveManifest()
+}
+
+// run by the log in the background
+func (l *Log) compact() {
+	removed, err := l.Compact()
+	if err != nil {
+		l.logger.Error("failed to compact", zap.Error(err))
+		return
+	}
+	if removed > 0 {
+		l.logger.Info("compacted segments", zap.Uint64("records_removed", removed))
+	}
+}
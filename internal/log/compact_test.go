@@ -0,0 +1,225 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompact(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compact-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Compaction.TombstoneRetention = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	old := time.Now().Add(-2 * time.Hour).UnixNano()
+	records := []*api.Record{
+		{Key: []byte("a"), Value: []byte("a1")},
+		{Key: []byte("b"), Value: []byte("b1")},
+		{Value: []byte("no key")},
+		{Key: []byte("a"), Value: []byte("a2")},
+		// tombstone within its retention
+		{Key: []byte("b")},
+		// expired tombstone
+		{Key: []byte("c"), Timestamp: old},
+		{Key: []byte("a"), Value: []byte("a3")},
+	}
+	for _, record := range records {
+		_, err := log.Replicate(record)
+		require.NoError(t, err)
+	}
+	removed, err := log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), removed)
+
+	check := func(log *Log) {
+		t.Helper()
+		for _, offset := range []uint64{0, 1, 3, 5} {
+			_, err := log.Read(offset)
+			require.Equal(t, api.ErrOffsetCompacted{Offset: offset}, err)
+		}
+		for _, offset := range []uint64{2, 4, 6} {
+			read, err := log.Read(offset)
+			require.NoError(t, err)
+			require.Equal(t, records[offset].Value, read.Value)
+			require.Equal(t, offset, read.Offset)
+		}
+		highest, err := log.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(6), highest)
+	}
+	check(log)
+
+	// compacting again changes nothing
+	removed, err = log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), removed)
+
+	// offsets survive a restart
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+	offset, err := log.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), offset)
+}
+
+func TestCompactInterrupted(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compact-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "a", "c"} {
+		_, err = log.Append(&api.Record{Key: []byte(key), Value: []byte(key)})
+		require.NoError(t, err)
+	}
+	// the first segment loses its first record, so its old index points
+	// the remaining offsets at the wrong records
+	index := path.Join(dir, "0.index")
+	stale, err := os.ReadFile(index)
+	require.NoError(t, err)
+	removed, err := log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), removed)
+	require.NoError(t, log.Close())
+
+	// a crash between replacing the segment's store and its index leaves
+	// an index that's newer than the store
+	require.NoError(t, os.WriteFile(index, stale, 0644))
+	m, err := readManifest(OSFS{}, dir)
+	require.NoError(t, err)
+	base := uint64(0)
+	m.Compacting = &base
+	require.NoError(t, writeManifest(OSFS{}, dir, m))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetCompacted{Offset: 0}, err)
+	read, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), read.Value)
+	m, err = readManifest(OSFS{}, dir)
+	require.NoError(t, err)
+	require.Nil(t, m.Compacting)
+}
+
+func TestCompactSwapFailed(t *testing.T) {
+	fs := &compactHookFS{MemFS: NewMemFS()}
+	c := Config{FS: fs}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog("log", c)
+	require.NoError(t, err)
+	defer log.Close()
+	for _, key := range []string{"a", "b", "a"} {
+		_, err = log.Append(&api.Record{Key: []byte(key), Value: []byte(key)})
+		require.NoError(t, err)
+	}
+
+	// the old segment serves reads until the new one is in place
+	fs.rename = func(string) error { return errors.New("rename failed") }
+	_, err = log.Compact()
+	require.Error(t, err)
+	for offset, want := range []string{"a", "b"} {
+		read, err := log.Read(uint64(offset))
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), read.Value)
+	}
+
+	fs.rename = nil
+	removed, err := log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), removed)
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetCompacted{Offset: 0}, err)
+}
+
+func TestCompactUnlocked(t *testing.T) {
+	fs := &compactHookFS{MemFS: NewMemFS()}
+	c := Config{FS: fs}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog("log", c)
+	require.NoError(t, err)
+	defer log.Close()
+	for _, key := range []string{"a", "b", "a"} {
+		_, err = log.Append(&api.Record{Key: []byte(key), Value: []byte(key)})
+		require.NoError(t, err)
+	}
+
+	// the log is read and appended to while the segment's rewritten
+	rewriting, resume := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	fs.open = func(string) error {
+		once.Do(func() {
+			close(rewriting)
+			<-resume
+		})
+		return nil
+	}
+	done := make(chan error)
+	go func() {
+		_, err := log.Compact()
+		done <- err
+	}()
+	<-rewriting
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), read.Value)
+	// the newer record doesn't count, as it came after compaction started
+	offset, err := log.Append(&api.Record{Key: []byte("b"), Value: []byte("b")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offset)
+	close(resume)
+	require.NoError(t, <-done)
+
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetCompacted{Offset: 0}, err)
+	read, err = log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), read.Value)
+}
+
+// a MemFS that calls open and rename, when set, with the names of the
+// files opened and renamed in the compaction dir, failing the call if
+// they fail
+type compactHookFS struct {
+	*MemFS
+	open, rename func(name string) error
+}
+
+func (fs *compactHookFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if fs.open != nil && path.Base(path.Dir(name)) == compactDir {
+		if err := fs.open(name); err != nil {
+			return nil, err
+		}
+	}
+	return fs.MemFS.OpenFile(name, flag, perm)
+}
+
+func (fs *compactHookFS) Rename(oldname, newname string) error {
+	if fs.rename != nil && path.Base(path.Dir(oldname)) == compactDir {
+		if err := fs.rename(oldname); err != nil {
+			return err
+		}
+	}
+	return fs.MemFS.Rename(oldname, newname)
+}
@@ -1,9 +1,75 @@
 package log
 
+import "time"
+
+// when appended records are committed to stable storage
+type SyncPolicy int
+
+const (
+	// leave writing out records to the store's buffer and the OS
+	SyncNone SyncPolicy = iota
+	// fsync after every Durability.Records appends
+	SyncEveryN
+	// fsync every Durability.Interval
+	SyncInterval
+	// fsync before every append returns. concurrent appends
+	// share an fsync rather than each paying for their own.
+	SyncAlways
+)
+
 type Config struct {
+	// opens the log without locking or writing to its dir, so tools can
+	// read a log that a running node has open. appends and anything else
+	// that changes the log fail with ErrReadOnly.
+	ReadOnly bool
+	// number of partitions a Manager creates a topic with, 0 for 1
+	Partitions uint32
+	// the file system the log is kept in, nil for the OS's. snapshots
+	// are always restored into the OS's.
+	FS      FS
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// size of the sparse time index, 0 for 1024
+		MaxTimeIndexBytes uint64
+		// store bytes to append between time index entries
+		TimeIndexIntervalBytes uint64
+		// how long after its first append a segment is rolled,
+		// 0 to roll on size alone
+		MaxSegmentAge time.Duration
+		// compresses appended records, nil to leave them uncompressed.
+		// records already written can be read whatever their codec.
+		Codec Codec
+		// encrypts the records of new segments with its current key, nil
+		// to leave them in plaintext. a segment's store records the ID of
+		// its key, so rotating keys leaves older segments readable.
+		Keys KeySource
+	}
+	// sealed segments outside either limit are removed in the background.
+	// a zero limit is not enforced.
+	Retention struct {
+		// total bytes the log's segments may take up
+		MaxBytes uint64
+		// how long a segment is kept after its newest record was appended
+		MaxAge time.Duration
+		// how often the limits are checked
+		CheckInterval time.Duration
+	}
+	Durability struct {
+		Sync SyncPolicy
+		// appends between fsyncs with SyncEveryN
+		Records uint64
+		// time between fsyncs with SyncInterval
+		Interval time.Duration
+	}
+	// key-based compaction of sealed segments
+	Compaction struct {
+		// keep only the newest record per key in sealed segments
+		Enabled bool
+		// how long tombstones are kept after being appended
+		TombstoneRetention time.Duration
+		// how often sealed segments are compacted
+		CheckInterval time.Duration
 	}
 }
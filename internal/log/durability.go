@@ -0,0 +1,82 @@
+package log
+
+import (
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// lets concurrent appends share fsyncs. an append waiting on a sync
+// while one is already running waits for the next, which then covers
+// every append made in the meantime.
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	syncing bool
+	// records below this offset are on stable storage
+	synced uint64
+}
+
+// blocks until the record at offset is synced, leading a sync with
+// fn if none is running. fn returns the offset it synced up to.
+func (g *groupCommit) wait(offset uint64, fn func() (uint64, error)) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.mu)
+	}
+	for g.synced <= offset {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		g.mu.Unlock()
+		synced, err := fn()
+		g.mu.Lock()
+		g.syncing = false
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		if synced > g.synced {
+			g.synced = synced
+		}
+	}
+	return nil
+}
+
+// forgets syncs past next once the records after it are removed
+func (g *groupCommit) truncate(next uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.synced > next {
+		g.synced = next
+	}
+}
+
+// waits until the record at offset meets the log's durability policy
+func (l *Log) commit(offset uint64) error {
+	if l.Config.Durability.Sync != SyncAlways {
+		return nil
+	}
+	return l.group.wait(offset, l.sync)
+}
+
+// syncs the active segment's store and returns the offset it's synced up to
+func (l *Log) sync() (uint64, error) {
+	l.mu.RLock()
+	s := l.activeSegment
+	next := s.nextOffset
+	l.mu.RUnlock()
+	// segments are synced as they're sealed, so syncing the active
+	// segment covers every record appended before next
+	return next, s.store.Sync()
+}
+
+// run by the log in the background with SyncInterval
+func (l *Log) syncInterval() {
+	if _, err := l.sync(); err != nil {
+		l.logger.Error("failed to sync", zap.Error(err))
+	}
+}
@@ -0,0 +1,84 @@
+package log
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupCommit(t *testing.T) {
+	g := groupCommit{}
+	var mu sync.Mutex
+	var syncs int
+	var next uint64
+	fn := func() (uint64, error) {
+		mu.Lock()
+		syncs++
+		synced := next
+		mu.Unlock()
+		// give other appends time to pile up behind this sync
+		time.Sleep(10 * time.Millisecond)
+		return synced, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		mu.Lock()
+		offset := next
+		next++
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, g.wait(offset, fn))
+		}()
+	}
+	wg.Wait()
+	require.Less(t, syncs, 20)
+	require.Equal(t, uint64(20), g.synced)
+}
+
+func TestDurability(t *testing.T) {
+	for scenario, sync := range map[string]SyncPolicy{
+		"every n":  SyncEveryN,
+		"interval": SyncInterval,
+		"always":   SyncAlways,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "durability-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Durability.Sync = sync
+			c.Durability.Records = 2
+			c.Durability.Interval = 10 * time.Millisecond
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			for i := 0; i < 2; i++ {
+				_, err = log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			// nothing is left in the store's buffer
+			require.Eventually(t, func() bool {
+				s := log.activeSegment.store
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				return s.buf.Buffered() == 0
+			}, time.Second, 10*time.Millisecond)
+
+			// a reset log's records start over unsynced
+			require.NoError(t, log.Reset())
+			require.Zero(t, log.group.synced)
+			_, err = log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package log
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// number of bytes after an encrypted store's header holding its key's ID
+const keyIDWidth = 4
+
+var (
+	// returned when a record doesn't decrypt with its store's key, as
+	// happens when a key is changed rather than rotated
+	errDecrypt = errors.New("record failed to decrypt")
+	// returned when opening an encrypted store without a KeySource
+	ErrNoKeySource = errors.New("segment is encrypted but no key source is configured")
+)
+
+// supplies the AES keys stores are encrypted with. keys are 16, 24 or 32
+// bytes long and never change once in use, new keys are added instead.
+type KeySource interface {
+	// returns the ID and key of the key new stores are encrypted with
+	Current() (uint32, []byte, error)
+	// returns the key with the given ID
+	Key(id uint32) ([]byte, error)
+}
+
+// a KeySource reading keys from a file with a key per line, written as its
+// ID and the hex of its key separated by a space. the key with the highest
+// ID is current. the file is read whenever a key is needed, so a key added
+// to it is used from the next segment on. blank lines and lines starting
+// with # are skipped.
+type KeyFile struct {
+	Path string
+}
+
+var _ KeySource = KeyFile{}
+
+func (k KeyFile) Current() (uint32, []byte, error) {
+	keys, err := k.keys()
+	if err != nil {
+		return 0, nil, err
+	}
+	var current uint32
+	var key []byte
+	for id, k := range keys {
+		if key == nil || id > current {
+			current, key = id, k
+		}
+	}
+	if key == nil {
+		return 0, nil, fmt.Errorf("no keys in %s", k.Path)
+	}
+	return current, key, nil
+}
+
+func (k KeyFile) Key(id uint32) ([]byte, error) {
+	keys, err := k.keys()
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys[id]
+	if !ok {
+		return nil, fmt.Errorf("no key %d in %s", id, k.Path)
+	}
+	return key, nil
+}
+
+func (k KeyFile) keys() (map[uint32][]byte, error) {
+	f, err := os.Open(k.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := make(map[uint32][]byte)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want an id and a key", k.Path, n)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", k.Path, n, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", k.Path, n, err)
+		}
+		if _, ok := keys[uint32(id)]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key %d", k.Path, n, id)
+		}
+		keys[uint32(id)] = key
+	}
+	return keys, scanner.Err()
+}
+
+// returns the AEAD records encrypted with the key are sealed with
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypts p, prefixed with the random nonce it was sealed with
+func encrypt(aead cipher.AEAD, p []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(p)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, p, nil), nil
+}
+
+// decrypts p encrypted by encrypt
+func decrypt(aead cipher.AEAD, p []byte) ([]byte, error) {
+	if len(p) < aead.NonceSize() {
+		return nil, errDecrypt
+	}
+	p, err := aead.Open(nil, p[:aead.NonceSize()], p[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return p, nil
+}
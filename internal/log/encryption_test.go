@@ -0,0 +1,165 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "keyfile-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	k := KeyFile{Path: path.Join(dir, "keys")}
+
+	_, _, err = k.Current()
+	require.Error(t, err)
+	require.NoError(t, os.WriteFile(k.Path, []byte(
+		"# rotated every quarter\n"+
+			"2 "+hexKey(2)+"\n"+
+			"\n"+
+			"1 "+hexKey(1)+"\n",
+	), 0600))
+	id, key, err := k.Current()
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), id)
+	require.Equal(t, bytes.Repeat([]byte{2}, 32), key)
+	key, err = k.Key(1)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte{1}, 32), key)
+	_, err = k.Key(3)
+	require.Error(t, err)
+
+	for _, bad := range []string{"1", "x " + hexKey(1), "1 not-hex", "1 00\n1 00"} {
+		require.NoError(t, os.WriteFile(k.Path, []byte(bad), 0600))
+		_, _, err = k.Current()
+		require.Error(t, err, bad)
+	}
+}
+
+// returns the hex of a 32 byte key made of the byte b
+func hexKey(b byte) string {
+	return fmt.Sprintf("%x", bytes.Repeat([]byte{b}, 32))
+}
+
+func TestEncryptedSegments(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, c Config, keys KeyFile){
+		"records aren't stored in plaintext":  testEncryptedAtRest,
+		"rotated keys keep segments readable": testEncryptedRotation,
+		"opening without the key fails":       testEncryptedMissingKey,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "encryption-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			keys := KeyFile{Path: path.Join(dir, "keys")}
+			require.NoError(t, os.WriteFile(keys.Path, []byte("1 "+hexKey(1)+"\n"), 0600))
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 3
+			c.Segment.Codec = Snappy
+			c.Segment.Keys = keys
+			fn(t, c, keys)
+		})
+	}
+}
+
+func testEncryptedAtRest(t *testing.T, c Config, keys KeyFile) {
+	dir := path.Join(path.Dir(keys.Path), "log")
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	want := []byte("top secret")
+	for i := 0; i < 4; i++ {
+		_, err = log.Append(&api.Record{Value: want})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	for _, base := range []uint64{0, 3} {
+		b, err := os.ReadFile(path.Join(dir, fmt.Sprintf("%d.store", base)))
+		require.NoError(t, err)
+		require.NotContains(t, string(b), string(want))
+	}
+
+	// every way of reading the log decrypts
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	record, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, want, record.Value)
+	record, err = log.Iterator(0).Next()
+	require.NoError(t, err)
+	require.Equal(t, want, record.Value)
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(log.Reader())
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), string(want))
+}
+
+func testEncryptedRotation(t *testing.T, c Config, keys KeyFile) {
+	dir := path.Join(path.Dir(keys.Path), "log")
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 2; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("before")})
+		require.NoError(t, err)
+	}
+	// the next segment is encrypted with the key added, the
+	// active segment keeps its key
+	require.NoError(t, os.WriteFile(keys.Path, []byte(
+		"1 "+hexKey(1)+"\n2 "+hexKey(2)+"\n",
+	), 0600))
+	for i := 0; i < 2; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("after")})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 2)
+	for i, want := range []uint32{1, 2} {
+		b := make([]byte, keyIDWidth)
+		_, err = log.segments[i].store.ReadAt(b, fileHeaderWidth)
+		require.NoError(t, err)
+		require.Equal(t, want, enc.Uint32(b))
+	}
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for offset, want := range []string{"before", "before", "after", "after"} {
+		record, err := log.Read(uint64(offset))
+		require.NoError(t, err)
+		require.Equal(t, want, string(record.Value))
+	}
+}
+
+func testEncryptedMissingKey(t *testing.T, c Config, keys KeyFile) {
+	dir := path.Join(path.Dir(keys.Path), "log")
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	before, err := os.ReadFile(path.Join(dir, "0.store"))
+	require.NoError(t, err)
+
+	plain := c
+	plain.Segment.Keys = nil
+	_, err = NewLog(dir, plain)
+	require.ErrorIs(t, err, ErrNoKeySource)
+
+	// a key replaced rather than rotated doesn't decrypt the records,
+	// which are left alone rather than cut as if torn
+	require.NoError(t, os.WriteFile(keys.Path, []byte("1 "+hexKey(9)+"\n"), 0600))
+	_, err = NewLog(dir, c)
+	require.ErrorIs(t, err, errDecrypt)
+	after, err := os.ReadFile(path.Join(dir, "0.store"))
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
@@ -0,0 +1,89 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// every segment file starts with a header naming the kind of file and the
+// version of the format it was written in, so that a format change can't
+// silently misread older files.
+const (
+	fileHeaderWidth = 8
+	// version of the format written by this package
+	formatVersion uint16 = 1
+	// the store's records are encrypted. the ID of their key follows
+	// the header.
+	flagEncrypted uint16 = 1 << 0
+	// flags this version understands, files with any other flag are refused
+	knownFlags = flagEncrypted
+)
+
+var (
+	storeMagic     = []byte("PLGS")
+	indexMagic     = []byte("PLGI")
+	timeIndexMagic = []byte("PLGT")
+
+	// returned for segment files written before they had a header,
+	// which Upgrade rewrites into the current format
+	ErrLegacyFormat = errors.New("segment file has no format header")
+)
+
+// writes a header with the given flags, followed by ext, to an empty file
+// and returns the flags, or checks an existing file's header and returns
+// its flags. read-only files are left without one.
+func initHeader(f File, magic []byte, flags uint16, ext []byte, readOnly bool) (uint16, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() < fileHeaderWidth+int64(len(ext)) {
+		if readOnly {
+			return 0, nil
+		}
+		// a new file, or one a crash left without its whole header
+		if err = f.Truncate(0); err != nil {
+			return 0, err
+		}
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err = f.Write(append(newHeader(magic, flags), ext...)); err != nil {
+			return 0, err
+		}
+		return flags, nil
+	}
+	h := make([]byte, fileHeaderWidth)
+	if _, err = f.ReadAt(h, 0); err != nil {
+		return 0, err
+	}
+	flags, err = parseHeader(h, magic)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	return flags, nil
+}
+
+func newHeader(magic []byte, flags uint16) []byte {
+	h := make([]byte, fileHeaderWidth)
+	copy(h, magic)
+	enc.PutUint16(h[4:6], formatVersion)
+	enc.PutUint16(h[6:8], flags)
+	return h
+}
+
+func parseHeader(h []byte, magic []byte) (uint16, error) {
+	if !bytes.Equal(h[:4], magic) {
+		return 0, ErrLegacyFormat
+	}
+	if version := enc.Uint16(h[4:6]); version == 0 || version > formatVersion {
+		return 0, fmt.Errorf("unsupported segment format version: %d", version)
+	}
+	flags := enc.Uint16(h[6:8])
+	if flags&^knownFlags != 0 {
+		return 0, fmt.Errorf("unsupported segment format flags: %#x", flags)
+	}
+	return flags, nil
+}
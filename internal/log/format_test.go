@@ -0,0 +1,70 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatHeader(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, f File){
+		"new file gets a header":     testHeaderWritten,
+		"headerless file is refused": testHeaderLegacy,
+		"newer version is refused":   testHeaderNewerVersion,
+		"unknown flags are refused":  testHeaderUnknownFlags,
+		"torn header is rewritten":   testHeaderTorn,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			f := createTemp(t, OSFS{}, "format-test")
+			defer f.Close()
+			fn(t, f)
+		})
+	}
+}
+
+func testHeaderWritten(t *testing.T, f File) {
+	_, err := initHeader(f, storeMagic, 0, nil, false)
+	require.NoError(t, err)
+	b, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, newHeader(storeMagic, 0), b)
+
+	// reopening checks the header rather than writing another
+	_, err = initHeader(f, storeMagic, 0, nil, false)
+	require.NoError(t, err)
+	// and a different kind of file is refused
+	_, err = initHeader(f, indexMagic, 0, nil, false)
+	require.ErrorIs(t, err, ErrLegacyFormat)
+}
+
+func testHeaderLegacy(t *testing.T, f File) {
+	_, err := f.Write(make([]byte, entWidth))
+	require.NoError(t, err)
+	_, err = newIndex(f, Config{})
+	require.ErrorIs(t, err, ErrLegacyFormat)
+}
+
+func testHeaderNewerVersion(t *testing.T, f File) {
+	h := newHeader(storeMagic, 0)
+	enc.PutUint16(h[4:6], formatVersion+1)
+	_, err := f.Write(h)
+	require.NoError(t, err)
+	_, err = newStore(f, Config{})
+	require.ErrorContains(t, err, "unsupported segment format version")
+}
+
+func testHeaderUnknownFlags(t *testing.T, f File) {
+	_, err := f.Write(newHeader(storeMagic, 1<<15))
+	require.NoError(t, err)
+	_, err = newStore(f, Config{})
+	require.ErrorContains(t, err, "unsupported segment format flags")
+}
+
+func testHeaderTorn(t *testing.T, f File) {
+	_, err := f.Write(storeMagic)
+	require.NoError(t, err)
+	s, err := newStore(f, Config{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(fileHeaderWidth), s.size)
+}
@@ -0,0 +1,640 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tysonmote/gommap"
+)
+
+// the file system a log is kept in. names are slash separated, as built
+// by path.Join.
+type FS interface {
+	// opens the named file with the flags of os.OpenFile
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	// removes the named file or empty dir
+	Remove(name string) error
+	// removes the named file or dir and everything in it, if it exists
+	RemoveAll(name string) error
+	// replaces newname with oldname, which may be a dir
+	Rename(oldname, newname string) error
+	MkdirAll(name string, perm os.FileMode) error
+	// returns the dir's entries sorted by name
+	ReadDir(name string) ([]os.DirEntry, error)
+	// commits the creation, removal and renaming of files in the dir to
+	// stable storage
+	SyncDir(name string) error
+	// opens the named file, creating it, with an exclusive lock that's
+	// released when the file is closed. fails with errLockHeld if it's
+	// already locked.
+	Lock(name string) (File, error)
+}
+
+// a file opened in an FS
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	// commits the file, and writes to its mapping, to stable storage
+	Sync() error
+	// maps the file's contents into memory, read-only unless the file was
+	// opened for writing. the mapping doesn't grow with the file, and is
+	// only valid until the file is closed. a file is mapped at most once.
+	Map() ([]byte, error)
+}
+
+// returned by FS.Lock when another holds the lock
+var errLockHeld = errors.New("lock held")
+
+// returns the file system the config's log is kept in
+func (c Config) fs() FS {
+	if c.FS == nil {
+		return OSFS{}
+	}
+	return c.FS
+}
+
+// reads the whole named file, as os.ReadFile does
+func readFile(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// the OS's file system, with files mapped by mmap
+type OSFS struct{}
+
+var _ FS = OSFS{}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &osFile{File: f, writable: writable(flag)}, nil
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (OSFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (OSFS) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+func (OSFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OSFS) SyncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	if err = d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// locks the file with flock, which the OS also releases when the
+// process exits
+func (OSFS) Lock(name string) (File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLockHeld
+		}
+		return nil, err
+	}
+	return &osFile{File: f, writable: true}, nil
+}
+
+type osFile struct {
+	*os.File
+	writable bool
+	mmap     gommap.MMap
+}
+
+func (f *osFile) Map() ([]byte, error) {
+	prot := gommap.PROT_READ
+	if f.writable {
+		prot |= gommap.PROT_WRITE
+	}
+	m, err := gommap.Map(f.Fd(), prot, gommap.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	f.mmap = m
+	return m, nil
+}
+
+func (f *osFile) Sync() error {
+	if f.mmap != nil && f.writable {
+		if err := f.mmap.Sync(gommap.MS_SYNC); err != nil {
+			return err
+		}
+	}
+	return f.File.Sync()
+}
+
+// unmaps the file before closing it
+func (f *osFile) Close() error {
+	if f.mmap != nil {
+		if err := f.mmap.UnsafeUnmap(); err != nil {
+			return err
+		}
+		f.mmap = nil
+	}
+	return f.File.Close()
+}
+
+// reports whether files opened with the given flags can be written
+func writable(flag int) bool {
+	return flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+var (
+	errWriteReadOnly = errors.New("file opened read-only")
+	errWriteAtAppend = errors.New("invalid use of WriteAt on file opened with O_APPEND")
+)
+
+// a file system held in memory, for tests and for logs that needn't
+// outlive the process. as on the OS, a file removed while open stays
+// readable and writable through the files it's open as.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	// every dir but the root, which always exists
+	dirs map[string]bool
+	// names of the locked files
+	locks map[string]bool
+}
+
+var _ FS = (*MemFS)(nil)
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memData),
+		dirs:  make(map[string]bool),
+		locks: make(map[string]bool),
+	}
+}
+
+// a file's contents, shared by the files it's open as
+type memData struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.openFile(name, flag)
+}
+
+// the caller must hold the lock
+func (m *MemFS) openFile(name string, flag int) (*memFile, error) {
+	d, ok := m.files[name]
+	switch {
+	case m.isDir(name):
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok && !m.isDir(path.Dir(name)):
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		d = &memData{modTime: time.Now()}
+		m.files[name] = d
+	}
+	f := &memFile{memData: d, name: name, flag: flag}
+	if flag&os.O_TRUNC != 0 && writable(flag) {
+		if err := f.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// reports whether name is a dir. the caller must hold the lock.
+func (m *MemFS) isDir(name string) bool {
+	return name == "." || m.dirs[name]
+}
+
+// reports whether name is in dir, or is dir
+func within(name, dir string) bool {
+	return name == dir || dir == "." || strings.HasPrefix(name, dir+"/")
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = path.Clean(name)
+	m.mu.Lock()
+	d, ok := m.files[name]
+	dir := m.isDir(name)
+	m.mu.Unlock()
+	if dir {
+		return memFileInfo{name: path.Base(name), dir: true}, nil
+	}
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return d.stat(name), nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.dirs[name] {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if len(m.entries(name)) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	name = path.Clean(name)
+	if name == "." {
+		return &fs.PathError{Op: "removeall", Path: name, Err: fs.ErrInvalid}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for f := range m.files {
+		if within(f, name) {
+			delete(m.files, f)
+		}
+	}
+	for d := range m.dirs {
+		if within(d, name) {
+			delete(m.dirs, d)
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Rename(oldname, newname string) error {
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fail := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	if !m.isDir(path.Dir(newname)) {
+		return fail(fs.ErrNotExist)
+	}
+	if d, ok := m.files[oldname]; ok {
+		if m.isDir(newname) {
+			return fail(syscall.EISDIR)
+		}
+		delete(m.files, oldname)
+		m.files[newname] = d
+		return nil
+	}
+	if !m.dirs[oldname] {
+		return fail(fs.ErrNotExist)
+	}
+	if _, ok := m.files[newname]; ok {
+		return fail(syscall.ENOTDIR)
+	}
+	if within(newname, oldname) || (m.dirs[newname] && len(m.entries(newname)) > 0) {
+		return fail(fs.ErrInvalid)
+	}
+	for f, d := range m.files {
+		if within(f, oldname) {
+			delete(m.files, f)
+			m.files[newname+strings.TrimPrefix(f, oldname)] = d
+		}
+	}
+	for d := range m.dirs {
+		if within(d, oldname) {
+			delete(m.dirs, d)
+			m.dirs[newname+strings.TrimPrefix(d, oldname)] = true
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := name; !m.isDir(dir); dir = path.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]os.DirEntry, error) {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isDir(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return m.entries(name), nil
+}
+
+// returns the entries of dir sorted by name. the caller must hold the
+// lock.
+func (m *MemFS) entries(dir string) []os.DirEntry {
+	var entries []os.DirEntry
+	for f, d := range m.files {
+		if path.Dir(f) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(d.stat(f)))
+		}
+	}
+	for d := range m.dirs {
+		if path.Dir(d) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(memFileInfo{name: path.Base(d), dir: true}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+func (m *MemFS) SyncDir(name string) error {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isDir(name) {
+		return &fs.PathError{Op: "sync", Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+func (m *MemFS) Lock(name string) (File, error) {
+	name = path.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locks[name] {
+		return nil, errLockHeld
+	}
+	f, err := m.openFile(name, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+	m.locks[name] = true
+	f.unlock = func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.locks, name)
+	}
+	return f, nil
+}
+
+// sets the named file's modification time, as os.Chtimes does
+func (m *MemFS) chtimes(name string, mtime time.Time) error {
+	name = path.Clean(name)
+	m.mu.Lock()
+	d, ok := m.files[name]
+	m.mu.Unlock()
+	if !ok {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.modTime = mtime
+	return nil
+}
+
+func (d *memData) stat(name string) os.FileInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return memFileInfo{
+		name:    path.Base(name),
+		size:    int64(len(d.data)),
+		modTime: d.modTime,
+	}
+}
+
+// grows the file with zeroes to hold size bytes, or cuts it back to them
+func (d *memData) resize(size int64) {
+	if n := int64(len(d.data)); size > n {
+		d.data = append(d.data, make([]byte, size-n)...)
+	} else {
+		d.data = d.data[:size]
+	}
+	d.modTime = time.Now()
+}
+
+type memFile struct {
+	*memData
+	name   string
+	flag   int
+	offset int64
+	closed bool
+	// releases the file's lock, for files opened by Lock
+	unlock func()
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+// returns an error for an operation on a closed file, or on a read-only
+// file if write is set
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if write && !writable(f.flag) {
+		return &fs.PathError{Op: op, Path: f.name, Err: errWriteReadOnly}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.data))
+	}
+	n := f.writeAt(p, f.offset)
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		return 0, errWriteAtAppend
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(p, off), nil
+}
+
+// the caller must hold the data's lock
+func (f *memFile) writeAt(p []byte, off int64) int {
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.resize(end)
+	}
+	f.modTime = time.Now()
+	return copy(f.data[off:], p)
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check("seek", false); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.mu.RLock()
+		offset += int64(len(f.data))
+		f.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if err := f.check("stat", false); err != nil {
+		return nil, err
+	}
+	return f.stat(f.name), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resize(size)
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	return f.check("sync", false)
+}
+
+// returns the file's contents themselves, so writes through the file
+// that don't grow it are seen by the mapping and the other way around
+func (f *memFile) Map() ([]byte, error) {
+	if err := f.check("map", false); err != nil {
+		return nil, err
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.data[:len(f.data):len(f.data)], nil
+}
+
+func (f *memFile) Close() error {
+	if err := f.check("close", false); err != nil {
+		return err
+	}
+	f.closed = true
+	if f.unlock != nil {
+		f.unlock()
+	}
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() any           { return nil }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
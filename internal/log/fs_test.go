@@ -0,0 +1,207 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// file systems the store, index and segment tests run against
+var fileSystems = map[string]func() FS{
+	"os":     func() FS { return OSFS{} },
+	"memory": func() FS { return NewMemFS() },
+}
+
+// creates an empty file in fs that's removed once the test ends
+func createTemp(t *testing.T, fs FS, pattern string) File {
+	t.Helper()
+	name := pattern
+	if _, ok := fs.(OSFS); ok {
+		f, err := os.CreateTemp("", pattern)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		name = f.Name()
+		t.Cleanup(func() { os.Remove(name) })
+	}
+	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	return f
+}
+
+// returns a dir in fs that's removed once the test ends
+func tempDir(t *testing.T, fs FS, pattern string) string {
+	t.Helper()
+	if _, ok := fs.(OSFS); !ok {
+		require.NoError(t, fs.MkdirAll(pattern, 0755))
+		return pattern
+	}
+	dir, err := os.MkdirTemp("", pattern)
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// sets the modification time of a file in fs
+func chtimes(fs FS, name string, mtime time.Time) error {
+	if m, ok := fs.(*MemFS); ok {
+		return m.chtimes(name, mtime)
+	}
+	return os.Chtimes(name, mtime, mtime)
+}
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	_, err := fs.OpenFile("a", os.O_RDWR, 0644)
+	require.True(t, os.IsNotExist(err))
+	_, err = fs.Stat("a")
+	require.True(t, os.IsNotExist(err))
+
+	f, err := fs.OpenFile("dir/../a", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	require.Equal(t, "a", f.Name())
+	_, err = fs.OpenFile("a", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	require.True(t, os.IsExist(err))
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = f.Write([]byte(" world"))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("j"), 0)
+	require.Error(t, err)
+	fi, err := fs.Stat("a")
+	require.NoError(t, err)
+	require.Equal(t, int64(11), fi.Size())
+
+	// files opened read-only can't be written, but see the writes of
+	// the files it's open as elsewhere through their mapping
+	r, err := fs.OpenFile("a", os.O_RDONLY, 0)
+	require.NoError(t, err)
+	_, err = r.Write([]byte("nope"))
+	require.Error(t, err)
+	m, err := r.Map()
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(m))
+	w, err := fs.OpenFile("a", os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = w.WriteAt([]byte("j"), 0)
+	require.NoError(t, err)
+	require.Equal(t, "jello world", string(m))
+
+	// a removed file stays open, and its name can be reused
+	require.NoError(t, fs.Remove("a"))
+	require.True(t, os.IsNotExist(fs.Remove("a")))
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "jello world", string(b))
+	f, err = fs.OpenFile("a", os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	fi, err = f.Stat()
+	require.NoError(t, err)
+	require.Zero(t, fi.Size())
+
+	// truncating grows the file with zeroes
+	_, err = w.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	require.NoError(t, w.Truncate(2))
+	require.NoError(t, w.Truncate(4))
+	b, err = io.ReadAll(w)
+	require.NoError(t, err)
+	require.Equal(t, []byte{'j', 'e', 0, 0}, b)
+
+	require.NoError(t, w.Close())
+	_, err = w.ReadAt(b, 0)
+	require.ErrorIs(t, err, os.ErrClosed)
+
+	// files are created in dirs that exist
+	_, err = fs.OpenFile("dir/a", os.O_RDWR|os.O_CREATE, 0644)
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, fs.MkdirAll("dir/sub", 0755))
+	for _, name := range []string{"dir/b", "dir/a", "dir/sub/c"} {
+		f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	fi, err = fs.Stat("dir/sub")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	entries, err := fs.ReadDir("dir")
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	require.Equal(t, []string{"a", "b", "sub"}, names)
+	require.True(t, entries[2].IsDir())
+
+	// dirs are renamed and removed with what's in them
+	require.Error(t, fs.Remove("dir/sub"))
+	require.NoError(t, fs.Rename("dir/sub", "moved"))
+	_, err = fs.Stat("moved/c")
+	require.NoError(t, err)
+	_, err = fs.Stat("dir/sub/c")
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, fs.RemoveAll("dir"))
+	_, err = fs.Stat("dir/a")
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, fs.RemoveAll("dir"))
+
+	// a lock is held until its file is closed
+	l, err := fs.Lock("moved/lock")
+	require.NoError(t, err)
+	_, err = fs.Lock("moved/lock")
+	require.Equal(t, errLockHeld, err)
+	require.NoError(t, l.Close())
+	l, err = fs.Lock("moved/lock")
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+}
+
+func TestLogInMemFS(t *testing.T) {
+	c := Config{FS: NewMemFS()}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Compaction.TombstoneRetention = time.Hour
+	log, err := NewLog("log", c)
+	require.NoError(t, err)
+	_, err = NewLog("log", c)
+	require.ErrorIs(t, err, ErrLocked)
+	for _, key := range []string{"a", "b", "a", "c", "a"} {
+		_, err = log.Append(&api.Record{Key: []byte(key), Value: []byte(key)})
+		require.NoError(t, err)
+	}
+	removed, err := log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), removed)
+	require.NoError(t, log.TruncateAfter(3))
+	var buf bytes.Buffer
+	require.NoError(t, log.Snapshot(&buf))
+	require.NotZero(t, buf.Len())
+	require.NoError(t, log.Close())
+	upgraded, err := Upgrade("log", c)
+	require.NoError(t, err)
+	require.Empty(t, upgraded)
+
+	// the log's files are all in the file system it was given
+	log, err = NewLog("log", c)
+	require.NoError(t, err)
+	for offset, want := range map[uint64]string{1: "b", 3: "c"} {
+		read, err := log.Read(offset)
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), read.Value)
+	}
+	for _, offset := range []uint64{0, 2} {
+		_, err = log.Read(offset)
+		require.Equal(t, api.ErrOffsetCompacted{Offset: offset}, err)
+	}
+	_, err = log.Read(4)
+	require.Error(t, err)
+	_, err = Upgrade("log", c)
+	require.ErrorIs(t, err, ErrLocked)
+	require.NoError(t, log.Remove())
+	_, err = c.FS.Stat("log")
+	require.True(t, os.IsNotExist(err))
+}
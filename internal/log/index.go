@@ -2,9 +2,6 @@ package log
 
 import (
 	"io"
-	"os"
-
-	"github.com/tysonmote/gommap"
 )
 
 var (
@@ -15,27 +12,44 @@ var (
 
 // index entries contains the record's offset and its position in the store file
 type index struct {
-	file *os.File
-	mmap gommap.MMap
+	file File
+	mmap []byte
 	size uint64
+	// opened by a read-only log, so the file is never written
+	readOnly bool
 }
 
 // create an index for a given file
-func newIndex(f *os.File, c Config) (*index, error) {
+func newIndex(f File, c Config) (*index, error) {
 	idx := &index{
-		file: f,
+		file:     f,
+		readOnly: c.ReadOnly,
+	}
+	if _, err := initHeader(f, indexMagic, 0, nil, c.ReadOnly); err != nil {
+		return nil, err
 	}
-	fi, err := os.Stat(f.Name())
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
-	idx.size = uint64(fi.Size())
-	// grpw the file to max index size
-	if err = os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
+	if c.ReadOnly {
+		// a file too new to have its header has no entries yet
+		if fi.Size() <= fileHeaderWidth {
+			return idx, nil
+		}
+		idx.size = uint64(fi.Size()) - fileHeaderWidth
+		if idx.mmap, err = f.Map(); err != nil {
+			return nil, err
+		}
+		return idx, nil
+	}
+	idx.size = uint64(fi.Size()) - fileHeaderWidth
+	// grpw the file to max index size, the header doesn't count against it
+	if err = f.Truncate(int64(fileHeaderWidth + c.Segment.MaxIndexBytes)); err != nil {
 		return nil, err
 	}
 	// mmap index file
-	if idx.mmap, err = gommap.Map(idx.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED); err != nil {
+	if idx.mmap, err = f.Map(); err != nil {
 		return nil, err
 	}
 	return idx, nil
@@ -43,16 +57,15 @@ func newIndex(f *os.File, c Config) (*index, error) {
 
 // close index file
 func (i *index) Close() error {
-	// make sure mmap sync data to file
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
-		return err
+	if i.readOnly {
+		return i.file.Close()
 	}
-	// persist file to stable storage
+	// persist file, and the mmap's writes to it, to stable storage
 	if err := i.file.Sync(); err != nil {
 		return err
 	}
 	// truncate file to actual size
-	if err := i.file.Truncate(int64(i.size)); err != nil {
+	if err := i.file.Truncate(int64(fileHeaderWidth + i.size)); err != nil {
 		return err
 	}
 	return i.file.Close()
@@ -73,26 +86,78 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	if i.size < pos+entWidth {
 		return 0, 0, io.EOF
 	}
+	e := i.entries()
 	// offset
-	out = enc.Uint32(i.mmap[pos : pos+offsetWidth])
+	out = enc.Uint32(e[pos : pos+offsetWidth])
 	// position
-	pos = enc.Uint64(i.mmap[pos+offsetWidth : pos+entWidth])
+	pos = enc.Uint64(e[pos+offsetWidth : pos+entWidth])
 	return out, pos, nil
 }
 
 // append the given offest and position to the index.
 func (i *index) Write(offset uint32, pos uint64) error {
 	// check fi there is space to write entry
-	if uint64(len(i.mmap)) < i.size+entWidth {
+	e := i.entries()
+	if uint64(len(e)) < i.size+entWidth {
 		return io.EOF
 	}
 	// encode offset and position and write to mmap
-	enc.PutUint32(i.mmap[i.size:i.size+offsetWidth], offset)
-	enc.PutUint64(i.mmap[i.size+offsetWidth:i.size+entWidth], pos)
+	enc.PutUint32(e[i.size:i.size+offsetWidth], offset)
+	enc.PutUint64(e[i.size+offsetWidth:i.size+entWidth], pos)
 	i.size += uint64(entWidth)
 	return nil
 }
 
+// the mapped file past its header
+func (i *index) entries() []byte {
+	if i.mmap == nil {
+		return nil
+	}
+	return i.mmap[fileHeaderWidth:]
+}
+
+// number of entries in the index
+func (i *index) Len() uint64 {
+	return i.size / entWidth
+}
+
+// returns the number of the first entry whose offset is at least off.
+// entries are in offset order but may skip offsets once compacted.
+func (i *index) Search(off uint32) uint64 {
+	lo, hi := uint64(0), i.Len()
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if o, _, _ := i.Read(int64(mid)); o < off {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// returns the store position of the record with the given offset,
+// or false if the index has no entry for it
+func (i *index) Find(off uint32) (pos uint64, ok bool) {
+	// until compacted, entries are dense and the offset is the entry
+	if o, pos, err := i.Read(int64(off)); err == nil && o == off {
+		return pos, true
+	}
+	n := i.Search(off)
+	o, pos, err := i.Read(int64(n))
+	if err != nil || o != off {
+		return 0, false
+	}
+	return pos, true
+}
+
+// drop every entry after the first n
+func (i *index) Truncate(n uint64) {
+	if n*entWidth < i.size {
+		i.size = n * entWidth
+	}
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
@@ -9,12 +9,19 @@ import (
 )
 
 func TestIndex(t *testing.T) {
-	f, err := os.CreateTemp(os.TempDir(), "index_test")
-	require.NoError(t, err)
-	defer os.Remove(f.Name())
+	for name, newFS := range fileSystems {
+		t.Run(name, func(t *testing.T) {
+			testIndex(t, newFS())
+		})
+	}
+}
+
+func testIndex(t *testing.T, fs FS) {
+	f := createTemp(t, fs, "index_test")
 
 	c := Config{}
 	c.Segment.MaxIndexBytes = 1024
+	c.FS = fs
 	// create index
 	idx, err := newIndex(f, c)
 	require.NoError(t, err)
@@ -45,7 +52,7 @@ func TestIndex(t *testing.T) {
 	err = idx.Close()
 	require.NoError(t, err)
 	// index should biuld its state from existing file
-	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	f, _ = fs.OpenFile(f.Name(), os.O_RDWR, 0600)
 	idx, err = newIndex(f, c)
 	require.NoError(t, err)
 	offset, pos, err := idx.Read(-1)
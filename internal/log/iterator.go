@@ -0,0 +1,183 @@
+package log
+
+import (
+	"io"
+	"os"
+	api "proglog/api/v1"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// reads a log's records in offset order by walking its store files, so
+// records after the first are read without looking them up in an index.
+// the segment being read is held open, so an iterator finishes reading a
+// segment that retention or compaction removes from the log under it.
+type Iterator struct {
+	// wait for records to be appended instead of returning io.EOF once
+	// every record has been read. set before the first call to Next.
+	Block bool
+
+	log *Log
+	// guards the position against Close
+	mu sync.Mutex
+	// offset of the next record
+	offset uint64
+	// segment being read, the store position of its next record and its
+	// gen when the position was found
+	segment *segment
+	pos     uint64
+	gen     uint64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// returns an iterator over the log's records from the first at or after
+// offset from. records that were removed, by retention or compaction,
+// are skipped.
+func (l *Log) Iterator(from uint64) *Iterator {
+	return &Iterator{
+		log:    l,
+		offset: from,
+		closed: make(chan struct{}),
+	}
+}
+
+// returns the next record. it returns io.EOF once the iterator is
+// closed, or once it has read every record if it doesn't Block.
+func (it *Iterator) Next() (*api.Record, error) {
+	for {
+		record, err := it.next()
+		if err != io.EOF || !it.Block {
+			return record, err
+		}
+		it.mu.Lock()
+		offset := it.offset
+		it.mu.Unlock()
+		select {
+		case <-it.closed:
+			return nil, io.EOF
+		case <-it.log.Wait(offset):
+		}
+	}
+}
+
+func (it *Iterator) next() (*api.Record, error) {
+	select {
+	case <-it.closed:
+		return nil, io.EOF
+	default:
+	}
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	l := it.log
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.done == nil {
+		return nil, os.ErrClosed
+	}
+	for {
+		// the segment's records were cut back since the position was found
+		if it.segment == nil || it.segment.gen != it.gen {
+			if err := it.seek(); err != nil {
+				return nil, err
+			}
+		}
+		frame, err := it.segment.store.ReadFrame(it.pos)
+		if err == io.EOF {
+			// the active segment is the only one still being appended to,
+			// and the next record appended to it gets its next offset
+			if it.segment == l.activeSegment {
+				if it.offset < it.segment.nextOffset {
+					it.offset = it.segment.nextOffset
+				}
+				return nil, io.EOF
+			}
+			// carry on in the next segment, past any offsets the end of
+			// this one lost to compaction
+			if it.offset < it.segment.nextOffset {
+				it.offset = it.segment.nextOffset
+			}
+			if err = it.release(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err == errChecksum {
+			return nil, api.ErrCorruptRecord{Offset: it.offset}
+		}
+		if err != nil {
+			return nil, err
+		}
+		p, err := it.segment.store.decode(frame)
+		if isCorrupt(err) {
+			return nil, api.ErrCorruptRecord{Offset: it.offset}
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(p, record); err != nil {
+			return nil, api.ErrCorruptRecord{Offset: it.offset}
+		}
+		it.pos += uint64(len(frame))
+		if record.Offset < it.offset {
+			continue
+		}
+		it.offset = record.Offset + 1
+		return record, nil
+	}
+}
+
+// finds the store position of the first record at or after the
+// iterator's offset, returning io.EOF if the log has none yet. the
+// caller must hold the log's lock.
+func (it *Iterator) seek() error {
+	if err := it.release(); err != nil {
+		return err
+	}
+	segments := it.log.segments
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].nextOffset > it.offset
+	})
+	if i == len(segments) {
+		return io.EOF
+	}
+	s := segments[i]
+	s.acquire()
+	it.segment, it.gen = s, s.gen
+	it.pos = s.store.start
+	if it.offset <= s.baseOffset {
+		return nil
+	}
+	n := s.index.Search(uint32(it.offset - s.baseOffset))
+	if n == s.index.Len() {
+		// the segment's remaining records were compacted away
+		it.pos = s.store.size
+		return nil
+	}
+	_, it.pos, _ = s.index.Read(int64(n))
+	return nil
+}
+
+// lets go of the segment being read
+func (it *Iterator) release() error {
+	if it.segment == nil {
+		return nil
+	}
+	s := it.segment
+	it.segment = nil
+	return s.release()
+}
+
+// stops the iterator, waking a Next blocked waiting for records
+func (it *Iterator) Close() error {
+	it.closeOnce.Do(func() {
+		close(it.closed)
+	})
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.release()
+}
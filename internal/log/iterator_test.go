@@ -0,0 +1,154 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterator(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"reads across segments":         testIteratorSegments,
+		"starts from an offset":         testIteratorFrom,
+		"skips removed records":         testIteratorRemoved,
+		"finishes a segment removed":    testIteratorPinned,
+		"finds its place after changes": testIteratorChanged,
+		"blocks for appends":            testIteratorBlock,
+		"close wakes a blocked next":    testIteratorClose,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "iterator-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 3
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for i := 0; i < 8; i++ {
+				_, err := log.Append(&api.Record{
+					Key:   []byte(fmt.Sprintf("key-%d", i%4)),
+					Value: []byte(fmt.Sprintf("record %d", i)),
+				})
+				require.NoError(t, err)
+			}
+			fn(t, log)
+		})
+	}
+}
+
+// reads the iterator until it's caught up and returns the offsets read
+func readAll(t *testing.T, it *Iterator) []uint64 {
+	t.Helper()
+	var offsets []uint64
+	for {
+		record, err := it.Next()
+		if err == io.EOF {
+			return offsets
+		}
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", record.Offset), string(record.Value))
+		offsets = append(offsets, record.Offset)
+	}
+}
+
+func testIteratorSegments(t *testing.T, log *Log) {
+	require.Len(t, log.segments, 3)
+	it := log.Iterator(0)
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7}, readAll(t, it))
+
+	// a caught up iterator picks up where it left off
+	_, err := log.Append(&api.Record{Value: []byte("record 8")})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{8}, readAll(t, it))
+}
+
+func testIteratorFrom(t *testing.T, log *Log) {
+	require.Equal(t, []uint64{4, 5, 6, 7}, readAll(t, log.Iterator(4)))
+	require.Empty(t, readAll(t, log.Iterator(8)))
+}
+
+func testIteratorRemoved(t *testing.T, log *Log) {
+	// only the newest record of each key survives in sealed segments
+	_, err := log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{4, 5, 6, 7}, readAll(t, log.Iterator(0)))
+
+	require.NoError(t, log.Truncate(2))
+	require.Equal(t, []uint64{4, 5, 6, 7}, readAll(t, log.Iterator(0)))
+}
+
+func testIteratorPinned(t *testing.T, log *Log) {
+	it := log.Iterator(0)
+	defer it.Close()
+	record, err := it.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), record.Offset)
+
+	// the segment being read is removed, but is still open for the iterator
+	first := log.segments[0]
+	require.NoError(t, log.Truncate(2))
+	_, err = os.Stat(first.store.Name())
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, []uint64{1, 2, 3, 4, 5, 6, 7}, readAll(t, it))
+	// and is closed once the iterator moves on
+	_, err = first.store.ReadFrame(first.store.start)
+	require.Error(t, err)
+}
+
+func testIteratorChanged(t *testing.T, log *Log) {
+	it := log.Iterator(0)
+	record, err := it.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), record.Offset)
+
+	// the segment being read is replaced by compaction, the iterator
+	// finishes the old one and reads the compacted ones after it
+	_, err = log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 4, 5, 6, 7}, readAll(t, it))
+
+	// and the records after the iterator are removed and appended again
+	require.NoError(t, log.TruncateAfter(5))
+	for i := 6; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Equal(t, []uint64{8, 9}, readAll(t, it))
+}
+
+func testIteratorBlock(t *testing.T, log *Log) {
+	it := log.Iterator(8)
+	it.Block = true
+	defer it.Close()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = log.Append(&api.Record{Value: []byte("record 8")})
+	}()
+	record, err := it.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), record.Offset)
+}
+
+func testIteratorClose(t *testing.T, log *Log) {
+	it := log.Iterator(8)
+	it.Block = true
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		it.Close()
+	}()
+	_, err := it.Next()
+	require.Equal(t, io.EOF, err)
+
+	// an iterator over a closed log stops too
+	it = log.Iterator(0)
+	require.NoError(t, log.Close())
+	_, err = it.Next()
+	require.ErrorIs(t, err, os.ErrClosed)
+}
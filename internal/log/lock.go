@@ -0,0 +1,57 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// file in the log's dir that's locked while the log is open
+const lockFile = "lock"
+
+var (
+	// returned when another log has the dir open
+	ErrLocked = errors.New("log dir is locked by another process")
+	// returned when changing a log opened with Config.ReadOnly
+	ErrReadOnly = errors.New("log is read-only")
+)
+
+// takes an exclusive lock on dir in fs, which is released when the
+// returned file is closed
+func lockDir(fs FS, dir string) (File, error) {
+	name := path.Join(dir, lockFile)
+	f, err := fs.Lock(name)
+	if err == errLockHeld {
+		// the holder leaves its pid for whoever runs into the lock
+		b, _ := readFile(fs, name)
+		if pid := strings.TrimSpace(string(b)); pid != "" {
+			return nil, fmt.Errorf("%w: %s held by pid %s", ErrLocked, dir, pid)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// releases the log's lock on its dir, if it holds one
+func (l *Log) unlock() error {
+	if l.lock == nil {
+		return nil
+	}
+	err := l.lock.Close()
+	l.lock = nil
+	return err
+}
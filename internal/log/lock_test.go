@@ -0,0 +1,80 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockDir(t *testing.T) {
+	for name, newFS := range fileSystems {
+		t.Run(name, func(t *testing.T) {
+			c := Config{FS: newFS()}
+			dir := tempDir(t, c.FS, "lock-test")
+
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			_, err = NewLog(dir, c)
+			require.ErrorIs(t, err, ErrLocked)
+			require.ErrorContains(t, err, "held by pid")
+
+			// closing the log releases the lock
+			require.NoError(t, log.Close())
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			require.NoError(t, log.Close())
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := os.MkdirTemp("", "read-only-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	record := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	// make sure the newest record has left the store's buffer
+	_, err = log.Read(2)
+	require.NoError(t, err)
+
+	c.ReadOnly = true
+	ro, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := uint64(0); i < 3; i++ {
+		read, err := ro.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, record.Value, read.Value)
+	}
+	highest, err := ro.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+
+	_, err = ro.Append(record)
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, ro.Truncate(0))
+	require.NoError(t, ro.Close())
+
+	// the running log carries on untouched
+	off, err := log.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, record.Value, read.Value)
+
+	_, err = NewLog(t.TempDir(), c)
+	require.Error(t, err)
+}
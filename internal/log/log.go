@@ -1,14 +1,24 @@
 package log
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
 	api "proglog/api/v1"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	errEmptyBatch = errors.New("empty batch")
+	// returned by a log's reader once the records it was reading were
+	// removed by TruncateAfter
+	errReaderTruncated = errors.New("log truncated while being read")
 )
 
 // log manages list of segments.
@@ -18,11 +28,38 @@ type Log struct {
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+
+	logger *zap.Logger
+	// appends since the last fsync with SyncEveryN
+	unsynced uint64
+	group    groupCommit
+	// closed to stop the log's background work
+	done chan struct{}
+	wg   sync.WaitGroup
+	// held on the log's dir while it's open
+	lock File
+	// closed, and replaced, whenever records are appended. see Wait.
+	appended chan struct{}
+	// held by snapshots while they copy the segment files, and by
+	// TruncateAfter, which changes them in place. taken before mu.
+	snapshots sync.RWMutex
+	// held by Compact while it runs, and by Close and Remove so the
+	// segments it reads outside the lock stay open. taken before snapshots.
+	compacting sync.Mutex
 }
 
 type originReader struct {
 	*store
-	offset int64
+	log     *Log
+	segment *segment
+	// the segment's gen when the reader was made
+	gen     uint64
+	release sync.Once
+	offset  int64
+	// offset of the next record to be read
+	record uint64
+	// verified bytes not yet returned to the caller
+	buf []byte
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -32,33 +69,176 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.MaxTimeIndexBytes == 0 {
+		c.Segment.MaxTimeIndexBytes = 1024
+	}
+	if c.Segment.TimeIndexIntervalBytes == 0 {
+		c.Segment.TimeIndexIntervalBytes = 4096
+	}
+	if c.Retention.CheckInterval == 0 {
+		c.Retention.CheckInterval = time.Minute
+	}
+	if c.Compaction.TombstoneRetention == 0 {
+		c.Compaction.TombstoneRetention = 24 * time.Hour
+	}
+	if c.Compaction.CheckInterval == 0 {
+		c.Compaction.CheckInterval = time.Minute
+	}
+	if c.Durability.Records == 0 {
+		c.Durability.Records = 1000
+	}
+	if c.Durability.Interval == 0 {
+		c.Durability.Interval = time.Second
+	}
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:      dir,
+		Config:   c,
+		logger:   zap.L().Named("log"),
+		appended: make(chan struct{}),
+	}
+	if err := l.setup(); err != nil {
+		return nil, err
+	}
+	l.start()
+	return l, nil
+}
+
+// starts the log's background work
+func (l *Log) start() {
+	l.done = make(chan struct{})
+	if l.Config.ReadOnly {
+		return
+	}
+	if l.Config.Retention.MaxBytes != 0 || l.Config.Retention.MaxAge != 0 {
+		l.background(l.Config.Retention.CheckInterval, l.enforceRetention)
+	}
+	if l.Config.Compaction.Enabled {
+		l.background(l.Config.Compaction.CheckInterval, l.compact)
+	}
+	if age := l.Config.Segment.MaxSegmentAge; age != 0 {
+		interval := time.Minute
+		if age < interval {
+			interval = age
+		}
+		l.background(interval, l.rollExpired)
 	}
-	return l, l.setup()
+	if l.Config.Durability.Sync == SyncInterval {
+		l.background(l.Config.Durability.Interval, l.syncInterval)
+	}
+}
+
+// calls fn every interval until the log is closed
+func (l *Log) background(interval time.Duration, fn func()) {
+	done := l.done
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
 }
 
-func (l *Log) setup() error {
-	files, err := os.ReadDir(l.Dir)
+// stops the log's background work and waits for it to finish
+func (l *Log) stop() {
+	l.mu.Lock()
+	done := l.done
+	l.done = nil
+	l.mu.Unlock()
+	if done != nil {
+		close(done)
+		l.wg.Wait()
+	}
+}
+
+func (l *Log) setup() (err error) {
+	l.segments, l.activeSegment = nil, nil
+	if !l.Config.ReadOnly {
+		if err = l.Config.fs().MkdirAll(l.Dir, 0755); err != nil {
+			return err
+		}
+		if l.lock, err = lockDir(l.Config.fs(), l.Dir); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				l.unlock()
+			}
+		}()
+	}
+	m, err := l.reconcile()
 	if err != nil {
 		return err
 	}
-	var baseOffsets []uint64
-	for _, file := range files {
-		offsetStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		offset, _ := strconv.ParseUint(offsetStr, 10, 0)
-		baseOffsets = append(baseOffsets, offset)
+	listed := m.Segments
+	// a segment whose files compaction was replacing when the log stopped
+	// can have an index that points into its old store, so it's removed
+	// to be rebuilt as the segment is loaded
+	if m.Compacting != nil && !l.Config.ReadOnly {
+		l.logger.Warn("finishing compaction", zap.Uint64("base_offset", *m.Compacting))
+		name := path.Join(l.Dir, fmt.Sprintf("%d.index", *m.Compacting))
+		if err = l.Config.fs().Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
 	// load segments that already exists on disk
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+	for _, m := range listed {
+		if err = l.newSegment(m.BaseOffset); err != nil {
+			return err
+		}
+	}
+	for i := 0; i+1 < len(l.segments); i++ {
+		// compaction can remove a sealed segment's newest records, so its
+		// next offset comes from the manifest or the following segment
+		if listed[i].Sealed {
+			l.segments[i].nextOffset = listed[i].NextOffset
+		} else {
+			l.segments[i].nextOffset = l.segments[i+1].baseOffset
+		}
+		if err = l.segments[i].store.Seal(); err != nil {
+			return err
+		}
+	}
+	if l.Config.ReadOnly {
+		if l.segments == nil {
+			return fmt.Errorf("no segments in %s", l.Dir)
+		}
+		return nil
+	}
+	// a crash can leave the active segment with a torn store
+	// or an index that was never truncated, so repair it
+	if l.activeSegment != nil {
+		r, err := l.activeSegment.recover()
+		if err != nil {
 			return err
 		}
-		i++
+		if r.changed() {
+			l.logger.Warn(
+				"repaired segment",
+				zap.Uint64("base_offset", l.activeSegment.baseOffset),
+				zap.Uint64("next_offset", l.activeSegment.nextOffset),
+				zap.Uint64("store_bytes_truncated", r.storeBytes),
+				zap.Uint64("index_entries_dropped", r.droppedEntries),
+				zap.Uint64("index_entries_rebuilt", r.rebuiltEntries),
+			)
+		}
+		// records may be gone from the end of a compacted segment
+		// that was made active again, but not their offsets
+		if next := listed[len(listed)-1].NextOffset; next > l.activeSegment.nextOffset {
+			l.activeSegment.nextOffset = next
+		}
+	}
+	// finish removing records that a crash interrupted
+	if m.TruncateAfter != nil && l.segments != nil {
+		l.logger.Warn("finishing truncation", zap.Uint64("offset", *m.TruncateAfter))
+		return l.truncateAfter(*m.TruncateAfter, true)
 	}
 	// if log is new, bootstrap initial segment
 	if l.segments == nil {
@@ -66,60 +246,232 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
-	return nil
+	return l.saveManifest()
 }
 
-// appends record to the log
+// appends record to the log, stamped with the time it's appended
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	return l.appendOne(record, false)
+}
+
+// appends a record copied from another server's log, keeping the time it
+// was appended there. only replication should set a record's time.
+func (l *Log) Replicate(record *api.Record) (uint64, error) {
+	return l.appendOne(record, true)
+}
+
+func (l *Log) appendOne(record *api.Record, keepTime bool) (uint64, error) {
 	l.mu.Lock()
-	defer l.mu.Unlock()
-	offset, err := l.activeSegment.Append(record)
+	offset, err := l.append(record, keepTime)
+	if err == nil {
+		l.notify()
+	}
+	l.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return offset, l.commit(offset)
+}
+
+// appends the records under a single lock so they get a contiguous range
+// of offsets, rolling segments as needed, and returns the first and last.
+// the batch is appended whole or not at all.
+func (l *Log) AppendBatch(records []*api.Record) (first, last uint64, err error) {
+	if len(records) == 0 {
+		return 0, 0, errEmptyBatch
+	}
+	l.mu.Lock()
+	first = l.activeSegment.nextOffset
+	for _, record := range records {
+		if last, err = l.append(record, false); err != nil {
+			// take back the records appended before the failure. the lock
+			// has been held since, so no reader has seen them, and readers
+			// of the records before them carry on.
+			if l.activeSegment.nextOffset != first {
+				if rerr := l.removeAfter(first-1, false); rerr != nil {
+					err = fmt.Errorf("%w, and failed to remove the batch's records: %v", err, rerr)
+				}
+			}
+			l.mu.Unlock()
+			return 0, 0, err
+		}
+	}
+	// waiters are woken once for the whole batch
+	l.notify()
+	l.mu.Unlock()
+	return first, last, l.commit(last)
+}
+
+// appends record to the active segment, keeping its time if keepTime is
+// set. the caller must hold the lock.
+func (l *Log) append(record *api.Record, keepTime bool) (uint64, error) {
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	appendFn := l.activeSegment.Append
+	if keepTime {
+		appendFn = l.activeSegment.Replicate
+	}
+	offset, err := appendFn(record)
 	if err != nil {
 		return 0, err
 	}
+	sync := l.Config.Durability.Sync
+	if sync == SyncEveryN {
+		l.unsynced++
+		if l.unsynced >= l.Config.Durability.Records {
+			if err = l.activeSegment.store.Sync(); err != nil {
+				return 0, err
+			}
+			l.unsynced = 0
+		}
+	}
 	// if segment is at its max size, make a new active segment
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(offset + 1)
+		err = l.roll()
 	}
 	return offset, err
 }
 
+// seals the active segment and makes a new active segment after it.
+// the caller must hold the lock.
+func (l *Log) roll() error {
+	// only the active segment is synced from here on, so
+	// records left unsynced in it are synced as it's sealed
+	if l.Config.Durability.Sync != SyncNone {
+		if err := l.activeSegment.store.Sync(); err != nil {
+			return err
+		}
+		l.unsynced = 0
+	}
+	// the old store is sealed only once there's a segment to take its
+	// place, so a failed roll leaves it open to appends
+	old := l.activeSegment
+	if err := l.newSegment(old.nextOffset); err != nil {
+		return err
+	}
+	if err := old.store.Seal(); err != nil {
+		return err
+	}
+	return l.saveManifest()
+}
+
+// rolls the active segment once it's too old, so that a quiet log's
+// segments are still sealed and handed to retention on schedule
+func (l *Log) rollExpired() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.activeSegment.IsExpired() {
+		return
+	}
+	if err := l.roll(); err != nil {
+		l.logger.Error("failed to roll segment", zap.Error(err))
+	}
+}
+
+// wakes the waiters on the records appended. the caller must hold the lock.
+func (l *Log) notify() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// returns a channel that's closed once the log's next offset is past
+// offset, so the record at offset has been appended, or the log is
+// closed. offset may be compacted or truncated away in the meantime, so
+// the record should be read rather than assumed to be there.
+func (l *Log) Wait(offset uint64) <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.done == nil || l.activeSegment.nextOffset > offset {
+		ready := make(chan struct{})
+		close(ready)
+		return ready
+	}
+	return l.appended
+}
+
 // read record stored at the given offset
 func (l *Log) Read(offset uint64) (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	// find segment that contains the given record
-	var s *segment
-	for _, segment := range l.segments {
-		if segment.baseOffset <= offset && offset < segment.nextOffset {
-			s = segment
-			break
-		}
-	}
-	if s == nil || s.nextOffset <= offset {
+	s := l.segmentFor(offset)
+	if s == nil {
 		return nil, api.ErrOffsetOutOfRange{Offset: offset}
 	}
 	return s.Read(offset)
 }
 
+// returns the segment containing offset, or nil if no segment does.
+// the caller must hold the lock.
+func (l *Log) segmentFor(offset uint64) *segment {
+	// segments are sorted by base offset, so binary search
+	// for the last segment starting at or before offset
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset > offset
+	}) - 1
+	if i < 0 || l.segments[i].nextOffset <= offset {
+		return nil
+	}
+	return l.segments[i]
+}
+
+// returns the offset of the first record appended at or after t. if every
+// record is older, the offset the next appended record will get is returned.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	ts := t.UnixNano()
+	for _, s := range l.segments {
+		offset, ok, err := s.OffsetForTime(ts)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return offset, nil
+		}
+	}
+	return l.activeSegment.nextOffset, nil
+}
+
 // close log's segments
 func (l *Log) Close() error {
+	l.stop()
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	// wake the waiters, which find the log closed
+	l.notify()
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
 		}
 	}
-	return nil
+	return l.unlock()
 }
 
-// closes the log and remove its data
+// closes the log and remove its data. readers still reading the
+// segments keep them open until they're done.
 func (l *Log) Remove() error {
-	if err := l.Close(); err != nil {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	l.stop()
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.notify()
+	for _, segment := range l.segments {
+		if err := segment.retire(); err != nil {
+			return err
+		}
+	}
+	if err := l.unlock(); err != nil {
 		return err
 	}
-	return os.RemoveAll(l.Dir)
+	return l.Config.fs().RemoveAll(l.Dir)
 }
 
 // remove the log and create new log
@@ -127,7 +479,15 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
-	return l.setup()
+	if err := l.setup(); err != nil {
+		return err
+	}
+	// the new log's records haven't been synced, whatever offsets the
+	// old log's had
+	l.unsynced = 0
+	l.group.truncate(l.activeSegment.nextOffset)
+	l.start()
+	return nil
 }
 
 // for replication
@@ -149,38 +509,139 @@ func (l *Log) HighestOffset() (uint64, error) {
 
 // removes all segments whose highest offset is lower than the lowest
 func (l *Log) Truncate(lowest uint64) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	var segments []*segment
+	var segments, removed []*segment
 	for _, s := range l.segments {
 		if s.nextOffset <= lowest+1 {
-			if err := s.Remove(); err != nil {
-				return err
-			}
+			removed = append(removed, s)
 			continue
 		}
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	// segments leave the manifest before their files are removed
+	if err := l.saveManifest(); err != nil {
+		return err
+	}
+	for _, s := range removed {
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// returns an io.Reader to read the whole log
-func (l *Log) Reader() io.Reader {
+// reads the whole log
+type logReader struct {
+	io.Reader
+	origins []*originReader
+}
+
+// returns a reader of the whole log. the log's segments are held open
+// until they've been read or the reader is closed, so removing them from
+// the log doesn't cut the reader short.
+func (l *Log) Reader() io.ReadCloser {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	r := &logReader{}
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+		segment.acquire()
+		o := &originReader{
+			store:   segment.store,
+			log:     l,
+			segment: segment,
+			gen:     segment.gen,
+			offset:  int64(segment.store.start),
+			record:  segment.baseOffset,
+		}
+		r.origins = append(r.origins, o)
+		readers[i] = o
 	}
 	// concatenate segments' store
-	return io.MultiReader(readers...)
+	r.Reader = io.MultiReader(readers...)
+	return r
 }
 
+// releases the segments not yet read
+func (r *logReader) Close() error {
+	var err error
+	for _, o := range r.origins {
+		if rerr := o.close(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// releases the reader's segment
+func (o *originReader) close() error {
+	var err error
+	o.release.Do(func() {
+		err = o.segment.release()
+	})
+	return err
+}
+
+// reads the store a record at a time so every record is verified
+// against its checksum before being handed out
 func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.offset)
-	o.offset += int64(n)
-	return n, err
+	if len(o.buf) == 0 {
+		b, err := o.next()
+		if err == io.EOF {
+			if cerr := o.close(); cerr != nil {
+				return 0, cerr
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		o.buf = b
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+// reads the next record under the log's lock, which stores are unmapped
+// and truncated under, and returns it as if it had been written in
+// plaintext
+func (o *originReader) next() ([]byte, error) {
+	o.log.mu.RLock()
+	defer o.log.mu.RUnlock()
+	if o.segment.gen != o.gen {
+		return nil, errReaderTruncated
+	}
+	// the log was closed, and the segment with it
+	if o.segment.isClosed() {
+		return nil, os.ErrClosed
+	}
+	b, err := o.ReadFrame(uint64(o.offset))
+	if err == errChecksum {
+		return nil, api.ErrCorruptRecord{Offset: o.record}
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.offset += int64(len(b))
+	o.record++
+	if b[0] != 0 || o.aead != nil {
+		p, err := o.decode(b)
+		if isCorrupt(err) {
+			return nil, api.ErrCorruptRecord{Offset: o.record - 1}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return append(header(p, 0), p...), nil
+	}
+	// a sealed store's frames are slices of its mapping, which needn't
+	// outlive the lock
+	return append([]byte(nil), b...), nil
 }
 
 // create new segment
@@ -1,10 +1,13 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"path"
 	api "proglog/api/v1"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
@@ -16,7 +19,17 @@ func TestLog(t *testing.T) {
 		"offset out of range error":        testOutOfRangeErr,
 		"init with existing segments":      testInitExisting,
 		"reader":                           testReader,
+		"reader outlives removal":          testReaderRemoved,
+		"reader cut short by truncation":   testReaderTruncated,
+		"reader past a failed batch":       testReaderBatchFailed,
+		"reader of a closed log":           testReaderClosed,
+		"wait for appends":                 testWait,
 		"truncate":                         testTruncate,
+		"corrupt record":                   testCorruptRecord,
+		"recover after crash":              testRecover,
+		"recover rolled segments":          testRecoverRolled,
+		"offset for time":                  testOffsetForTime,
+		"append batch":                     testAppendBatch,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := os.MkdirTemp("", "store-test")
@@ -92,11 +105,124 @@ func testReader(t *testing.T, log *Log) {
 	require.NoError(t, err)
 
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b[headerWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
 }
 
+func testReaderRemoved(t *testing.T, log *Log) {
+	append := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	reader := log.Reader()
+	want, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+
+	// the reader's segments stay open while it reads them
+	require.NoError(t, log.Truncate(1))
+	require.NoError(t, log.Reset())
+	got, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	require.NoError(t, reader.Close())
+}
+
+func testReaderTruncated(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	reader := log.Reader()
+	_, err := io.ReadFull(reader, make([]byte, 5))
+	require.NoError(t, err)
+
+	// the records being read are gone, and the sealed store the reader
+	// was reading has been unmapped to be truncated
+	require.NoError(t, log.TruncateAfter(0))
+	_, err = io.ReadAll(reader)
+	require.Equal(t, errReaderTruncated, err)
+	require.NoError(t, reader.Close())
+}
+
+func testReaderBatchFailed(t *testing.T, log *Log) {
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	reader := log.Reader()
+	_, err := io.ReadFull(reader, make([]byte, 5))
+	require.NoError(t, err)
+	it := log.Iterator(0)
+	_, err = it.Next()
+	require.NoError(t, err)
+
+	// taking back a failed batch removes nothing the readers could see
+	_, _, err = log.AppendBatch([]*api.Record{
+		{Value: []byte("hello world")},
+		{Headers: []*api.Header{{Key: "\xff"}}},
+	})
+	require.Error(t, err)
+	b, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NotEmpty(t, b)
+	require.NoError(t, reader.Close())
+	read, err := it.Next()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), read.Offset)
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func testReaderClosed(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	reader := log.Reader()
+	_, err := io.ReadFull(reader, make([]byte, 5))
+	require.NoError(t, err)
+
+	// the segments being read are closed and unmapped with the log
+	require.NoError(t, log.Close())
+	_, err = io.ReadAll(reader)
+	require.ErrorIs(t, err, os.ErrClosed)
+	require.NoError(t, reader.Close())
+}
+
+func testWait(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	// a record already appended doesn't wait
+	requireClosed(t, log.Wait(0))
+
+	wait := log.Wait(1)
+	select {
+	case <-wait:
+		t.Fatal("woken before the record was appended")
+	default:
+	}
+	_, _, err = log.AppendBatch([]*api.Record{{Value: []byte("hello")}, {Value: []byte("world")}})
+	require.NoError(t, err)
+	requireClosed(t, wait)
+
+	// closing the log wakes waiters too
+	wait = log.Wait(3)
+	require.NoError(t, log.Close())
+	requireClosed(t, wait)
+	requireClosed(t, log.Wait(3))
+}
+
+func requireClosed(t *testing.T, ch <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed")
+	}
+}
+
 func testTruncate(t *testing.T, log *Log) {
 	append := &api.Record{Value: []byte("hello world")}
 	for i := 0; i < 3; i++ {
@@ -109,3 +235,261 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func testCorruptRecord(t *testing.T, log *Log) {
+	append := &api.Record{Value: []byte("hello world")}
+	offset, err := log.Append(append)
+	require.NoError(t, err)
+	_, err = log.Read(offset)
+	require.NoError(t, err)
+
+	// overwrite the record's last byte
+	s := log.segments[0].store
+	f, err := os.OpenFile(s.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(s.size-1))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = log.Read(offset)
+	apiErr, ok := err.(api.ErrCorruptRecord)
+	require.True(t, ok)
+	require.Equal(t, offset, apiErr.Offset)
+
+	_, err = io.ReadAll(log.Reader())
+	require.Equal(t, api.ErrCorruptRecord{Offset: offset}, err)
+}
+
+func testRecover(t *testing.T, log *Log) {
+	append := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	// flush the store but leave the index untruncated, as a crash would
+	_, err := log.Read(2)
+	require.NoError(t, err)
+	// the OS releases a crashed process's lock
+	require.NoError(t, log.unlock())
+
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	offset, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offset)
+
+	offset, err = n.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offset)
+	read, err := n.Read(offset)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+}
+
+func testRecoverRolled(t *testing.T, log *Log) {
+	start := time.Now()
+	append := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 4)
+	// the sealed segments' indexes were never truncated, and were
+	// written no earlier than their stores
+	for _, s := range log.segments[:3] {
+		fi, err := os.Stat(s.index.Name())
+		require.NoError(t, err)
+		require.Equal(t, int64(fileHeaderWidth+log.Config.Segment.MaxIndexBytes), fi.Size())
+		require.NoError(t, os.Chtimes(s.store.Name(), fi.ModTime(), fi.ModTime()))
+	}
+	require.NoError(t, log.unlock())
+
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	for _, s := range n.segments[:3] {
+		require.Equal(t, uint64(1), s.index.Len())
+	}
+	offset, err := n.OffsetForTime(start.Add(-time.Second))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+	it := n.Iterator(1)
+	defer it.Close()
+	for _, want := range []uint64{1, 2} {
+		record, err := it.Next()
+		require.NoError(t, err)
+		require.Equal(t, want, record.Offset)
+	}
+}
+
+func testOffsetForTime(t *testing.T, log *Log) {
+	start := time.Now()
+	var times []time.Time
+	for i := 0; i < 5; i++ {
+		ts := start.Add(time.Duration(i) * time.Minute)
+		times = append(times, ts)
+		_, err := log.Replicate(&api.Record{
+			Value:     []byte("hello world"),
+			Timestamp: ts.UnixNano(),
+		})
+		require.NoError(t, err)
+	}
+	for i, ts := range times {
+		offset, err := log.OffsetForTime(ts)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), offset)
+		// between two records resolves to the later one
+		offset, err = log.OffsetForTime(ts.Add(-time.Second))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), offset)
+	}
+	// newer than every record resolves to the next offset
+	offset, err := log.OffsetForTime(start.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), offset)
+
+	// appends are stamped, whatever time the record was given
+	before := time.Now()
+	offset, err = log.Append(&api.Record{
+		Value:     []byte("hello world"),
+		Timestamp: start.Add(-time.Hour).UnixNano(),
+	})
+	require.NoError(t, err)
+	read, err := log.Read(offset)
+	require.NoError(t, err)
+	require.False(t, time.Unix(0, read.Timestamp).Before(before))
+}
+
+func testAppendBatch(t *testing.T, log *Log) {
+	// a batch that fails partway through, after rolling segments, isn't
+	// appended at all
+	var batch []*api.Record
+	for i := 0; i < 3; i++ {
+		batch = append(batch, &api.Record{Value: []byte("hello world")})
+	}
+	batch = append(batch, &api.Record{Headers: []*api.Header{{Key: "\xff"}}})
+	_, _, err := log.AppendBatch(batch)
+	require.Error(t, err)
+	require.Len(t, log.segments, 1)
+	m, err := readManifest(OSFS{}, log.Dir)
+	require.NoError(t, err)
+	require.Len(t, m.Segments, 1)
+
+	offset, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+
+	batch = nil
+	for i := 0; i < 5; i++ {
+		batch = append(batch, &api.Record{Value: []byte("hello world")})
+	}
+	first, last, err := log.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(5), last)
+	// the batch rolled segments partway through
+	require.Greater(t, len(log.segments), 2)
+	for offset := first; offset <= last; offset++ {
+		read, err := log.Read(offset)
+		require.NoError(t, err)
+		require.Equal(t, offset, read.Offset)
+	}
+
+	_, _, err = log.AppendBatch(nil)
+	require.Equal(t, errEmptyBatch, err)
+}
+
+func BenchmarkLogRead(b *testing.B) {
+	for _, segments := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("segments=%d", segments), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "log-bench")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+			// a record per segment
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth
+			log, err := NewLog(dir, c)
+			require.NoError(b, err)
+			defer log.Close()
+			for i := 0; i < segments; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(b, err)
+			}
+			// the same number of offsets, spread across the log, whatever
+			// its size. reading every segment in turn touches a different
+			// mapping each read, and the cache misses that costs grow with
+			// the number of segments where the lookup hardly does.
+			var offsets []uint64
+			for i := 0; i < 10; i++ {
+				offsets = append(offsets, uint64(i*segments/10))
+			}
+
+			b.Run("read", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := log.Read(offsets[i%len(offsets)]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run("lookup", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if log.segmentFor(offsets[i%len(offsets)]) == nil {
+						b.Fatal("segment not found")
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestLogRollFailed(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-roll-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// a dir in the way of the next segment's store fails the roll
+	require.NoError(t, os.Mkdir(path.Join(dir, "1.store"), 0755))
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.Error(t, err)
+
+	// the active segment still takes appends, and rolls once it can
+	require.NoError(t, os.Remove(path.Join(dir, "1.store")))
+	offset, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offset)
+	require.Equal(t, uint64(2), log.activeSegment.baseOffset)
+	for _, offset := range []uint64{0, 1} {
+		_, err = log.Read(offset)
+		require.NoError(t, err)
+	}
+}
+
+func TestLogRollByAge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "log-roll-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxSegmentAge = 50 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	// the quiet segment is rolled in the background
+	require.Eventually(t, func() bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		return len(log.segments) == 2 && log.activeSegment.baseOffset == 1
+	}, time.Second, 10*time.Millisecond)
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+}
@@ -0,0 +1,291 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	api "proglog/api/v1"
+
+	"go.uber.org/zap"
+)
+
+// topic of requests that don't name one
+const DefaultTopic = "default"
+
+// topics are directory names, so they're kept to a safe set of characters
+var topicName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+// a named stream of records split into partitions, each its own log in a
+// subdirectory of the topic's directory named after its number
+type Topic struct {
+	Name       string
+	Partitions []*Log
+}
+
+// returns the log of one of the topic's partitions
+func (t *Topic) Partition(p uint32) (*Log, error) {
+	if p >= uint32(len(t.Partitions)) {
+		return nil, api.ErrPartitionNotFound{Topic: t.Name, Partition: p}
+	}
+	return t.Partitions[p], nil
+}
+
+// hosts topics, each in a subdirectory of Dir
+type Manager struct {
+	Dir string
+	// config of the topics without their own in Topics
+	Config Config
+	Topics map[string]Config
+
+	mu     sync.RWMutex
+	topics map[string]*Topic
+	lock   File
+	logger *zap.Logger
+}
+
+// opens the topics in dir, creating dir if it doesn't exist
+func NewManager(dir string, c Config, topics map[string]Config) (*Manager, error) {
+	m := &Manager{
+		Dir:    dir,
+		Config: c,
+		Topics: topics,
+		topics: make(map[string]*Topic),
+		logger: zap.L().Named("log"),
+	}
+	if err := c.fs().MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var err error
+	if m.lock, err = lockDir(c.fs(), dir); err != nil {
+		return nil, err
+	}
+	if err = m.setup(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Manager) setup() error {
+	// a log from before topics was kept in Dir itself
+	if err := m.migrate(m.Dir, path.Join(m.Dir, DefaultTopic, "0")); err != nil {
+		return err
+	}
+	entries, err := m.Config.fs().ReadDir(m.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !validTopic(e.Name()) {
+			continue
+		}
+		dir := path.Join(m.Dir, e.Name())
+		// and a topic from before partitions was a log in the topic's dir
+		if err = m.migrate(dir, path.Join(dir, "0")); err != nil {
+			return err
+		}
+		n, err := partitions(m.Config.fs(), dir)
+		if err != nil {
+			return err
+		}
+		if _, err = m.open(e.Name(), n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moves a log kept in src into dst. the manifest is moved last, so a
+// move cut short by a crash is picked up again on startup.
+func (m *Manager) migrate(src, dst string) error {
+	fs := m.Config.fs()
+	onDisk, err := segmentFiles(fs, src)
+	if err != nil {
+		return err
+	}
+	_, err = fs.Stat(path.Join(src, manifestFile))
+	if os.IsNotExist(err) && len(onDisk) == 0 {
+		return nil
+	}
+	if err = fs.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		switch ext := path.Ext(e.Name()); {
+		case e.IsDir():
+			// scratch space the log left behind
+			if e.Name() == compactDir || e.Name() == upgradeDir {
+				if err = fs.RemoveAll(path.Join(src, e.Name())); err != nil {
+					return err
+				}
+			}
+			continue
+		case ext != ".store" && ext != ".index" && ext != ".timeindex":
+			continue
+		}
+		if err = fs.Rename(path.Join(src, e.Name()), path.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+	err = fs.Rename(path.Join(src, manifestFile), path.Join(dst, manifestFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = fs.SyncDir(dst); err != nil {
+		return err
+	}
+	m.logger.Info("moved log", zap.String("from", src), zap.String("to", dst))
+	return fs.SyncDir(src)
+}
+
+// returns the number of partitions in a topic's dir
+func partitions(fs FS, dir string) (uint32, error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var n uint32
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		p, err := strconv.ParseUint(e.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		if uint32(p)+1 > n {
+			n = uint32(p) + 1
+		}
+	}
+	return n, nil
+}
+
+func validTopic(topic string) bool {
+	return topicName.MatchString(topic) && topic != "." && topic != ".."
+}
+
+// opens the topic's partitions, creating any that don't exist. the
+// caller must hold the lock.
+func (m *Manager) open(topic string, partitions uint32) (*Topic, error) {
+	c, ok := m.Topics[topic]
+	if !ok {
+		c = m.Config
+	}
+	// topics are kept in the manager's file system
+	c.FS = m.Config.FS
+	if partitions == 0 {
+		partitions = c.Partitions
+	}
+	if partitions == 0 {
+		partitions = 1
+	}
+	t := &Topic{Name: topic}
+	for p := uint32(0); p < partitions; p++ {
+		l, err := NewLog(path.Join(m.Dir, topic, fmt.Sprint(p)), c)
+		if err != nil {
+			for _, l := range t.Partitions {
+				l.Close()
+			}
+			return nil, err
+		}
+		t.Partitions = append(t.Partitions, l)
+	}
+	m.topics[topic] = t
+	return t, nil
+}
+
+// returns an existing topic. the empty topic is the default topic.
+func (m *Manager) Topic(topic string) (*Topic, error) {
+	if topic == "" {
+		topic = DefaultTopic
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, ok := m.topics[topic]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: topic}
+	}
+	return t, nil
+}
+
+// returns the topic, creating it with the given number of partitions if
+// it doesn't exist and reporting whether it did. 0 partitions takes the
+// number from the topic's config.
+func (m *Manager) CreateTopic(topic string, partitions uint32) (*Topic, bool, error) {
+	if topic == "" {
+		topic = DefaultTopic
+	}
+	if !validTopic(topic) {
+		return nil, false, api.ErrInvalidTopic{Topic: topic}
+	}
+	m.mu.RLock()
+	t, ok := m.topics[topic]
+	m.mu.RUnlock()
+	if ok {
+		return t, false, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// created while the lock was released
+	if t, ok := m.topics[topic]; ok {
+		return t, false, nil
+	}
+	if m.topics == nil {
+		return nil, false, os.ErrClosed
+	}
+	t, err := m.open(topic, partitions)
+	if err != nil {
+		return nil, false, err
+	}
+	m.logger.Info(
+		"created topic",
+		zap.String("topic", topic),
+		zap.Int("partitions", len(t.Partitions)),
+	)
+	return t, true, nil
+}
+
+// returns the topics in name order
+func (m *Manager) ListTopics() []*Topic {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	topics := make([]*Topic, 0, len(m.topics))
+	for _, t := range m.topics {
+		topics = append(topics, t)
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+	return topics
+}
+
+// closes every partition's log and releases the lock on Dir
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var err error
+	for _, t := range m.topics {
+		for _, l := range t.Partitions {
+			if cerr := l.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	m.topics = nil
+	if m.lock != nil {
+		if cerr := m.lock.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		m.lock = nil
+	}
+	return err
+}
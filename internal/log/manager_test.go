@@ -0,0 +1,118 @@
+package log
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager(t *testing.T) {
+	dir, err := os.MkdirTemp("", "manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	small := Config{}
+	small.Segment.MaxStoreBytes = 32
+	small.Partitions = 3
+	m, err := NewManager(dir, c, map[string]Config{"small": small})
+	require.NoError(t, err)
+	require.Empty(t, m.ListTopics())
+
+	// the empty topic is the default topic
+	def, created, err := m.CreateTopic("", 0)
+	require.NoError(t, err)
+	require.True(t, created)
+	require.Equal(t, DefaultTopic, def.Name)
+	require.Len(t, def.Partitions, 1)
+	_, err = def.Partitions[0].Append(&api.Record{Value: []byte("default")})
+	require.NoError(t, err)
+	_, err = m.Topic("orders")
+	require.Equal(t, api.ErrTopicNotFound{Topic: "orders"}, err)
+
+	_, created, err = m.CreateTopic("orders", 2)
+	require.NoError(t, err)
+	require.True(t, created)
+	// an existing topic keeps its partitions
+	orders, created, err := m.CreateTopic("orders", 4)
+	require.NoError(t, err)
+	require.False(t, created)
+	require.Len(t, orders.Partitions, 2)
+	p, err := orders.Partition(1)
+	require.NoError(t, err)
+	_, err = p.Append(&api.Record{Value: []byte("order")})
+	require.NoError(t, err)
+	_, err = orders.Partition(2)
+	require.Equal(t, api.ErrPartitionNotFound{Topic: "orders", Partition: 2}, err)
+
+	// topics get their own config
+	sm, _, err := m.CreateTopic("small", 0)
+	require.NoError(t, err)
+	require.Len(t, sm.Partitions, 3)
+	require.Equal(t, uint64(32), sm.Partitions[2].Config.Segment.MaxStoreBytes)
+	require.Equal(t, uint64(1024), p.Config.Segment.MaxStoreBytes)
+
+	for _, topic := range []string{"..", "a/b", string(make([]byte, 250))} {
+		_, _, err = m.CreateTopic(topic, 0)
+		require.Equal(t, api.ErrInvalidTopic{Topic: topic}, err)
+	}
+
+	// topics are found again on startup
+	_, err = NewManager(dir, c, nil)
+	require.ErrorIs(t, err, ErrLocked)
+	require.NoError(t, m.Close())
+	m, err = NewManager(dir, c, nil)
+	require.NoError(t, err)
+	defer m.Close()
+	var names []string
+	for _, topic := range m.ListTopics() {
+		names = append(names, topic.Name)
+	}
+	require.Equal(t, []string{DefaultTopic, "orders", "small"}, names)
+	orders, err = m.Topic("orders")
+	require.NoError(t, err)
+	require.Len(t, orders.Partitions, 2)
+	record, err := orders.Partitions[1].Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order"), record.Value)
+}
+
+func TestManagerMigrate(t *testing.T) {
+	for scenario, dir := range map[string]func(root string) string{
+		// a log from before topics was kept in the root dir
+		"log before topics": func(root string) string { return root },
+		// and one from before partitions in its topic's dir
+		"topic before partitions": func(root string) string {
+			return path.Join(root, DefaultTopic)
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			root, err := os.MkdirTemp("", "manager-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(root)
+
+			l, err := NewLog(dir(root), Config{})
+			require.NoError(t, err)
+			_, err = l.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			require.NoError(t, l.Close())
+
+			m, err := NewManager(root, Config{}, nil)
+			require.NoError(t, err)
+			defer m.Close()
+			topic, err := m.Topic("")
+			require.NoError(t, err)
+			require.Len(t, topic.Partitions, 1)
+			record, err := topic.Partitions[0].Read(0)
+			require.NoError(t, err)
+			require.Equal(t, []byte("hello world"), record.Value)
+			_, err = os.Stat(path.Join(dir(root), manifestFile))
+			require.True(t, os.IsNotExist(err))
+		})
+	}
+}
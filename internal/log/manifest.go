@@ -0,0 +1,197 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// file in the log's dir recording its live segments
+const manifestFile = "manifest.json"
+
+// the log's segments in offset order. it's rewritten whenever a segment
+// rolls or is removed, and is the source of truth for which files in the
+// log's dir are segments.
+type manifest struct {
+	Segments []manifestSegment `json:"segments"`
+	// set while the records after an offset are being removed, so that
+	// a removal cut short by a crash is finished on startup
+	TruncateAfter *uint64 `json:"truncate_after,omitempty"`
+	// base offset of the segment whose files compaction is replacing, so
+	// that a segment left with its new store and its old index by a crash
+	// has its index rebuilt on startup
+	Compacting *uint64 `json:"compacting,omitempty"`
+}
+
+type manifestSegment struct {
+	BaseOffset uint64 `json:"base_offset"`
+	// only kept up to date for sealed segments, the active segment's
+	// next offset is recovered from its files
+	NextOffset uint64 `json:"next_offset"`
+	Sealed     bool   `json:"sealed"`
+}
+
+// reads the manifest in dir, returning nil if there isn't one
+func readManifest(fs FS, dir string) (*manifest, error) {
+	b, err := readFile(fs, path.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err = json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("%s: %w", manifestFile, err)
+	}
+	return m, nil
+}
+
+// replaces the manifest in dir so that a crash leaves either the old or
+// the new manifest, never a partial one
+func writeManifest(fs FS, dir string, m *manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(dir, manifestFile+".tmp")
+	f, err := fs.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = fs.Rename(tmp, path.Join(dir, manifestFile)); err != nil {
+		return err
+	}
+	return fs.SyncDir(dir)
+}
+
+// writes the manifest for the log's current segments. the caller must
+// hold the lock.
+func (l *Log) saveManifest() error {
+	return writeManifest(l.Config.fs(), l.Dir, l.manifest())
+}
+
+func (l *Log) manifest() *manifest {
+	m := &manifest{Segments: make([]manifestSegment, len(l.segments))}
+	for i, s := range l.segments {
+		m.Segments[i] = manifestSegment{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			Sealed:     s != l.activeSegment,
+		}
+	}
+	return m
+}
+
+// returns the base offsets of the segments with files in dir. files that
+// aren't named after a segment are skipped.
+func segmentFiles(fs FS, dir string) ([]uint64, error) {
+	files, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[uint64]bool)
+	var baseOffsets []uint64
+	for _, file := range files {
+		// segments are files, directories are scratch space
+		if file.IsDir() {
+			continue
+		}
+		ext := path.Ext(file.Name())
+		if ext != ".store" && ext != ".index" && ext != ".timeindex" {
+			continue
+		}
+		offset, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		// a segment's files all share its base offset
+		if !seen[offset] {
+			seen[offset] = true
+			baseOffsets = append(baseOffsets, offset)
+		}
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	return baseOffsets, nil
+}
+
+// reconciles the manifest with the segment files in the log's dir and
+// returns it with the segments to load. segments are added to the manifest
+// before their files are removed and after their files are created, so
+// files past the manifest's last segment were rolled and files before it
+// were being removed when the log stopped.
+func (l *Log) reconcile() (*manifest, error) {
+	onDisk, err := segmentFiles(l.Config.fs(), l.Dir)
+	if err != nil {
+		return nil, err
+	}
+	m, err := readManifest(l.Config.fs(), l.Dir)
+	if err != nil {
+		return nil, err
+	}
+	// a log from before the manifest has only its files to go by
+	if m == nil {
+		m = &manifest{Segments: make([]manifestSegment, len(onDisk))}
+		for i, baseOffset := range onDisk {
+			m.Segments[i] = manifestSegment{BaseOffset: baseOffset}
+		}
+		return m, nil
+	}
+	listed := make(map[uint64]bool)
+	for _, s := range m.Segments {
+		listed[s.BaseOffset] = true
+	}
+	present := make(map[uint64]bool)
+	segments := m.Segments
+	for _, baseOffset := range onDisk {
+		present[baseOffset] = true
+		switch {
+		case listed[baseOffset]:
+		case len(segments) == 0 || baseOffset > segments[len(segments)-1].BaseOffset:
+			l.logger.Warn("found rolled segment missing from manifest", zap.Uint64("base_offset", baseOffset))
+			segments = append(segments, manifestSegment{BaseOffset: baseOffset})
+		case l.Config.ReadOnly:
+			// left for the log's owner to clean up
+		default:
+			l.logger.Warn("removing segment missing from manifest", zap.Uint64("base_offset", baseOffset))
+			for _, ext := range []string{".store", ".index", ".timeindex"} {
+				name := path.Join(l.Dir, fmt.Sprintf("%d%s", baseOffset, ext))
+				if err = l.Config.fs().Remove(name); err != nil && !os.IsNotExist(err) {
+					return nil, err
+				}
+			}
+		}
+	}
+	m.Segments = segments[:0]
+	for _, s := range segments {
+		if present[s.BaseOffset] {
+			m.Segments = append(m.Segments, s)
+			continue
+		}
+		// the segment was removed with the records after an offset
+		if m.TruncateAfter != nil && s.BaseOffset >= *m.TruncateAfter+1 {
+			continue
+		}
+		return nil, fmt.Errorf("segment %d in manifest is missing from %s", s.BaseOffset, l.Dir)
+	}
+	return m, nil
+}
@@ -0,0 +1,131 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"tracks rolled and truncated segments": testManifestRoll,
+		"ignores stray files":                  testManifestStrayFiles,
+		"adopts segments rolled after a crash": testManifestAdopt,
+		"removes segments left by a crash":     testManifestOrphans,
+		"missing segment fails":                testManifestMissing,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "manifest-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth
+			fn(t, dir, c)
+		})
+	}
+}
+
+// appends n records to a new log in dir, a record per segment
+func appendRecords(t *testing.T, dir string, c Config, n int) *Log {
+	t.Helper()
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	return log
+}
+
+func testManifestRoll(t *testing.T, dir string, c Config) {
+	log := appendRecords(t, dir, c, 3)
+	defer log.Close()
+
+	m, err := readManifest(OSFS{}, dir)
+	require.NoError(t, err)
+	require.Equal(t, []manifestSegment{
+		{BaseOffset: 0, NextOffset: 1, Sealed: true},
+		{BaseOffset: 1, NextOffset: 2, Sealed: true},
+		{BaseOffset: 2, NextOffset: 3, Sealed: true},
+		{BaseOffset: 3, NextOffset: 3},
+	}, m.Segments)
+
+	require.NoError(t, log.Truncate(1))
+	m, err = readManifest(OSFS{}, dir)
+	require.NoError(t, err)
+	require.Len(t, m.Segments, 2)
+	require.Equal(t, uint64(2), m.Segments[0].BaseOffset)
+}
+
+func testManifestStrayFiles(t *testing.T, dir string, c Config) {
+	log := appendRecords(t, dir, c, 2)
+	require.NoError(t, log.Close())
+	for _, name := range []string{"notes.txt", "backup.store", "0.store.bak"} {
+		require.NoError(t, os.WriteFile(path.Join(dir, name), []byte("stray"), 0644))
+	}
+	// even without a manifest, only segment files are segments
+	require.NoError(t, os.Remove(path.Join(dir, manifestFile)))
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.segments, 3)
+	record, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), record.Offset)
+	_, err = os.Stat(path.Join(dir, manifestFile))
+	require.NoError(t, err)
+}
+
+func testManifestAdopt(t *testing.T, dir string, c Config) {
+	log := appendRecords(t, dir, c, 1)
+	m, err := readManifest(OSFS{}, dir)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	// the log stopped after rolling but before saving the manifest
+	require.NoError(t, writeManifest(OSFS{}, dir, m))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Len(t, log.segments, 3)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), highest)
+}
+
+func testManifestOrphans(t *testing.T, dir string, c Config) {
+	log := appendRecords(t, dir, c, 2)
+	m, err := readManifest(OSFS{}, dir)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	// the log stopped after saving the manifest but before removing files
+	m.Segments = m.Segments[1:]
+	require.NoError(t, writeManifest(OSFS{}, dir, m))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), lowest)
+	_, err = os.Stat(path.Join(dir, "0.store"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func testManifestMissing(t *testing.T, dir string, c Config) {
+	log := appendRecords(t, dir, c, 2)
+	require.NoError(t, log.Close())
+	for _, ext := range []string{".store", ".index", ".timeindex"} {
+		require.NoError(t, os.Remove(path.Join(dir, fmt.Sprintf("1%s", ext))))
+	}
+	_, err := NewLog(dir, c)
+	require.ErrorContains(t, err, "segment 1 in manifest is missing")
+}
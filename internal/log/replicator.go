@@ -3,13 +3,20 @@ package log
 import (
 	"context"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	api "proglog/api/v1"
 )
 
+// how often the topics of the servers being replicated are checked for
+// new ones
+const topicPollInterval = time.Second
+
 type Replicator struct {
 	// options to configure grpc client.
 	DialOptions []grpc.DialOption
@@ -55,41 +62,131 @@ func (r *Replicator) replicate(addr string, leave chan struct{}) {
 
 	client := api.NewLogClient(cc)
 
-	// consume stream
-	ctx := context.Background()
-	stream, err := client.ConsumeStream(ctx,
-		&api.ConsumeRequest{
-			Offset: 0,
-		},
-	)
-
-	records := make(chan *api.Record)
+	// the partitions are replicated until the server leaves
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	go func() {
-		for {
-			recv, err := stream.Recv()
-			if err != nil {
-				r.logError(err, "failed to recieve", addr)
-				return
+	// topics being replicated and their number of partitions
+	replicating := make(map[string]uint32)
+	ticker := time.NewTicker(topicPollInterval)
+	defer ticker.Stop()
+	for {
+		topics, err := r.topics(ctx, client)
+		if err != nil {
+			r.logError(err, "failed to list topics", addr)
+		}
+		for _, t := range topics {
+			if replicating[t.Name] >= t.Partitions {
+				continue
+			}
+			if err = r.createTopic(ctx, t); err != nil {
+				r.logError(err, "failed to create topic", addr)
+				continue
 			}
-			records <- recv.Record
+			for p := replicating[t.Name]; p < t.Partitions; p++ {
+				wg.Add(1)
+				go func(topic string, partition uint32) {
+					defer wg.Done()
+					r.replicatePartition(ctx, client, addr, topic, partition)
+				}(t.Name, p)
+			}
+			replicating[t.Name] = t.Partitions
 		}
-	}()
 
-	for {
 		select {
 		case <-r.close:
 			return
 		case <-leave:
 			return
-		case record := <-records:
-			_, err = r.LocalServer.Produce(ctx,
-				&api.ProduceRequest{Record: record},
-			)
-			if err != nil {
-				r.logError(err, "failed to produce", addr)
-				return
-			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// returns the server's topics. a server with a single log is replicated
+// as the default topic.
+func (r *Replicator) topics(ctx context.Context, client api.LogClient) ([]*api.TopicInfo, error) {
+	res, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		return []*api.TopicInfo{{Partitions: 1}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.Topics, nil
+}
+
+// creates the topic locally with as many partitions as its source
+func (r *Replicator) createTopic(ctx context.Context, topic *api.TopicInfo) error {
+	_, err := r.LocalServer.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic:      topic.Name,
+		Partitions: topic.Partitions,
+	})
+	if status.Code(err) == codes.Unimplemented {
+		// the local server has a single log
+		return nil
+	}
+	return err
+}
+
+// copies the records of one of the server's partitions into the same
+// partition of the local server until ctx is canceled
+func (r *Replicator) replicatePartition(
+	ctx context.Context,
+	client api.LogClient,
+	addr, topic string,
+	partition uint32,
+) {
+	logError := func(err error, msg string) {
+		r.logger.Error(
+			msg,
+			zap.String("addr", addr),
+			zap.String("topic", topic),
+			zap.Uint32("partition", partition),
+			zap.Error(err),
+		)
+	}
+	stream, err := client.ConsumeStream(ctx,
+		&api.ConsumeRequest{
+			Offset:    0,
+			Topic:     topic,
+			Partition: partition,
+		},
+	)
+	if err != nil {
+		logError(err, "failed to consume")
+		return
+	}
+	for {
+		recv, err := stream.Recv()
+		if ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.DataLoss {
+			// the source's copy is corrupt, so it can't be replicated
+			logError(err, "corrupt record")
+			return
+		}
+		if err != nil {
+			logError(err, "failed to recieve")
+			return
+		}
+		_, err = r.LocalServer.Produce(ctx,
+			&api.ProduceRequest{
+				Record:        recv.Record,
+				Topic:         topic,
+				Partition:     &partition,
+				KeepTimestamp: true,
+			},
+		)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logError(err, "failed to produce")
+			return
 		}
 	}
 }
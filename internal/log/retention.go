@@ -0,0 +1,74 @@
+package log
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// removes sealed segments that fall outside the retention policy and
+// returns the base offsets of the removed segments. segments are only
+// removed from the front of the log, and the active segment never is.
+func (l *Log) EnforceRetention() ([]uint64, error) {
+	if l.Config.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	maxBytes, maxAge := l.Config.Retention.MaxBytes, l.Config.Retention.MaxAge
+	var total uint64
+	for _, s := range l.segments {
+		total += s.Size()
+	}
+	now := time.Now()
+	var removed []uint64
+	var freed uint64
+	n := 0
+	for ; l.segments[n] != l.activeSegment; n++ {
+		s := l.segments[n]
+		expired := false
+		if maxAge != 0 {
+			newest, err := s.newestAppend()
+			if err != nil {
+				return removed, err
+			}
+			expired = now.Sub(newest) > maxAge
+		}
+		if !expired && (maxBytes == 0 || total <= maxBytes) {
+			break
+		}
+		size := s.Size()
+		total -= size
+		freed += size
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	outside := l.segments[:n]
+	l.segments = l.segments[n:]
+	// segments leave the manifest before their files are removed
+	if err := l.saveManifest(); err != nil {
+		return nil, err
+	}
+	for _, s := range outside {
+		if err := s.Remove(); err != nil {
+			return removed, err
+		}
+		removed = append(removed, s.baseOffset)
+	}
+	if len(removed) > 0 {
+		l.logger.Info(
+			"removed segments outside retention",
+			zap.Uint64s("base_offsets", removed),
+			zap.Uint64("bytes", freed),
+		)
+	}
+	return removed, nil
+}
+
+// run by the log in the background
+func (l *Log) enforceRetention() {
+	if _, err := l.EnforceRetention(); err != nil {
+		l.logger.Error("failed to enforce retention", zap.Error(err))
+	}
+}
@@ -0,0 +1,118 @@
+package log
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetentionMaxBytes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "retention-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth
+	c.Retention.MaxBytes = 100
+	c.Retention.CheckInterval = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// a record per segment
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	removed, err := log.EnforceRetention()
+	require.NoError(t, err)
+	require.NotEmpty(t, removed)
+	require.Equal(t, uint64(0), removed[0])
+
+	var total uint64
+	for _, s := range log.segments {
+		total += s.Size()
+	}
+	require.LessOrEqual(t, total, c.Retention.MaxBytes)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(removed)), lowest)
+	_, err = log.Read(0)
+	require.Error(t, err)
+
+	// the active segment is never removed
+	log.Config.Retention.MaxBytes = 1
+	_, err = log.EnforceRetention()
+	require.NoError(t, err)
+	require.Len(t, log.segments, 1)
+	require.Equal(t, log.activeSegment, log.segments[0])
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "retention-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth
+	c.Retention.MaxAge = time.Hour
+	c.Retention.CheckInterval = 10 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	old := time.Now().Add(-2 * time.Hour).UnixNano()
+	for i := 0; i < 2; i++ {
+		_, err := log.Replicate(&api.Record{Value: []byte("old"), Timestamp: old})
+		require.NoError(t, err)
+	}
+	_, err = log.Append(&api.Record{Value: []byte("new")})
+	require.NoError(t, err)
+
+	// removed by the background check
+	require.Eventually(t, func() bool {
+		lowest, err := log.LowestOffset()
+		return err == nil && lowest == 2
+	}, time.Second, 10*time.Millisecond)
+	read, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), read.Value)
+}
+
+func TestRetentionUnstamped(t *testing.T) {
+	dir, err := os.MkdirTemp("", "retention-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// upgraded legacy records have no append time
+	writeLegacySegment(t, dir, 0, 3, true)
+	writeLegacySegment(t, dir, 3, 2, true)
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.MaxSegmentAge = time.Hour
+	c.Retention.MaxAge = time.Hour
+	_, err = Upgrade(dir, c)
+	require.NoError(t, err)
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// they're as old as their stores, not as old as the epoch
+	removed, err := log.EnforceRetention()
+	require.NoError(t, err)
+	require.Empty(t, removed)
+	_, err = log.Append(&api.Record{Value: []byte("new")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), log.activeSegment.baseOffset)
+
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(path.Join(dir, "0.store"), old, old))
+	removed, err = log.EnforceRetention()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0}, removed)
+}
@@ -2,11 +2,15 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"sync"
+	"time"
 
 	api "proglog/api/v1"
 
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -14,8 +18,30 @@ import (
 type segment struct {
 	store                  *store
 	index                  *index
+	timeIndex              *timeIndex
 	baseOffset, nextOffset uint64
 	config                 Config
+	// timestamp and store position of the last time index entry
+	lastTimestamp int64
+	lastTimePos   uint64
+	// when the segment's first record was appended, zero while empty
+	firstAppend time.Time
+	// bumped whenever the segment's records change in place, so
+	// iterators know to find their place again
+	gen uint64
+	// the index was rebuilt from a store with a record that couldn't be
+	// read back, so the offsets from corruptFrom on have no index entry
+	damaged     bool
+	corruptFrom uint64
+
+	mu sync.Mutex
+	// readers holding the segment open
+	refs int
+	// the segment left its log while referenced, and is closed once the
+	// last reference is released
+	retired bool
+	// the segment's files are closed, and its store unmapped
+	closed bool
 }
 
 // add new segment when current active segment hits its max size
@@ -26,99 +52,683 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	}
 
 	var err error
+	storePath := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store"))
+	indexPath := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index"))
+	timeIndexPath := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex"))
+	if c.ReadOnly {
+		return openSegment(s, storePath, indexPath, timeIndexPath)
+	}
+	fs := c.fs()
+	// check before the index file is created or touched
+	stale, err := indexStale(fs, storePath, indexPath)
+	if err != nil {
+		return nil, err
+	}
 	// create store
-	storeFile, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	storeFile, err := fs.OpenFile(storePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
 	}
-	if s.store, err = newStore(storeFile); err != nil {
+	if s.store, err = newStore(storeFile, c); err != nil {
+		storeFile.Close()
 		return nil, err
 	}
 	// create index
-	indexFile, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")), os.O_RDWR|os.O_CREATE, 0644)
+	indexFile, err := fs.OpenFile(indexPath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
+		s.store.Close()
 		return nil, err
 	}
 	if s.index, err = newIndex(indexFile, c); err != nil {
+		indexFile.Close()
+		s.store.Close()
+		return nil, err
+	}
+	// create time index
+	timeIndexFile, err := fs.OpenFile(timeIndexPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		s.store.Close()
+		s.index.Close()
+		return nil, err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile, c); err != nil {
+		timeIndexFile.Close()
+		s.store.Close()
+		s.index.Close()
 		return nil, err
 	}
-	// get last entry in index
-	if offset, _, err := s.index.Read(-1); err != nil {
-		s.nextOffset = baseOffset
-	} else {
-		s.nextOffset = baseOffset + uint64(offset) + 1
+	if stale {
+		r, err := s.rebuildIndex()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		zap.L().Named("log").Warn(
+			"rebuilt index",
+			zap.String("index", indexPath),
+			zap.Uint64("index_entries_rebuilt", r.rebuiltEntries),
+			zap.Uint64("store_bytes_unreadable", r.unreadableBytes),
+		)
+		return s, nil
+	}
+	// a crash leaves the index of every segment rolled since the log was
+	// opened at its full size, with its unwritten entries zeroed
+	s.trimIndex()
+	s.trimTimeIndex()
+	if err = s.loadFirstAppend(); err != nil {
+		s.Close()
+		return nil, err
 	}
 	return s, nil
 }
 
+// opens an existing segment's files read-only. a running node may be
+// appending to the segment, so its index is trimmed to the records that
+// have made it to the store rather than recovered.
+func openSegment(s *segment, storePath, indexPath, timeIndexPath string) (*segment, error) {
+	fs := s.config.fs()
+	storeFile, err := fs.OpenFile(storePath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if s.store, err = newStore(storeFile, s.config); err != nil {
+		storeFile.Close()
+		return nil, err
+	}
+	indexFile, err := fs.OpenFile(indexPath, os.O_RDONLY, 0)
+	if err != nil {
+		s.store.Close()
+		return nil, err
+	}
+	if s.index, err = newIndex(indexFile, s.config); err != nil {
+		indexFile.Close()
+		s.store.Close()
+		return nil, err
+	}
+	timeIndexFile, err := fs.OpenFile(timeIndexPath, os.O_RDONLY, 0)
+	if err != nil {
+		s.store.Close()
+		s.index.Close()
+		return nil, err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile, s.config); err != nil {
+		timeIndexFile.Close()
+		s.store.Close()
+		s.index.Close()
+		return nil, err
+	}
+	s.trimIndex()
+	s.trimTimeIndex()
+	if err = s.loadFirstAppend(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// drops trailing index entries that don't point at a whole record in the
+// store. only the index's size changes, so the files aren't written.
+func (s *segment) trimIndex() {
+	var n uint64
+	var last uint32
+	for ; n < s.index.Len(); n++ {
+		off, pos, _ := s.index.Read(int64(n))
+		if pos < s.store.start || pos+headerWidth > s.store.size || (n > 0 && off <= last) {
+			break
+		}
+		last = off
+	}
+	// the newest record may only be partly written
+	for ; n > 0; n-- {
+		off, pos, _ := s.index.Read(int64(n - 1))
+		if _, err := s.store.ReadFrame(pos); err == nil {
+			last = off
+			break
+		}
+	}
+	s.index.Truncate(n)
+	s.nextOffset = s.baseOffset
+	if n > 0 {
+		s.nextOffset += uint64(last) + 1
+	}
+}
+
+// removes the records after offset, which the segment must not start
+// past. a sealed segment becomes writable again.
+func (s *segment) TruncateAfter(offset uint64) error {
+	if err := s.store.Unseal(); err != nil {
+		return err
+	}
+	n := s.index.Search(uint32(offset + 1 - s.baseOffset))
+	if n < s.index.Len() {
+		_, pos, err := s.index.Read(int64(n))
+		if err != nil {
+			return err
+		}
+		if err = s.store.Truncate(pos); err != nil {
+			return err
+		}
+	}
+	// the store is cut back for good before the index is, so a crash
+	// leaves index entries past the store that recovery drops
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	s.index.Truncate(n)
+	if offset+1 < s.nextOffset {
+		s.nextOffset = offset + 1
+	}
+	s.trimTimeIndex()
+	return s.loadFirstAppend()
+}
+
+// the first record's timestamp stands in for when a reopened
+// segment's first record was appended
+func (s *segment) loadFirstAppend() error {
+	s.firstAppend = time.Time{}
+	off, pos, err := s.index.Read(0)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	record, err := s.readAt(pos, s.baseOffset+uint64(off))
+	// an index left behind by a crash can point past the store,
+	// recovering the segment loads its first append again
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.firstAppend = time.Unix(0, record.Timestamp)
+	if record.Timestamp == 0 {
+		s.firstAppend, err = s.modTime()
+	}
+	return err
+}
+
+// records written before they were stamped have no append time, so the
+// store's last write stands in for theirs
+func (s *segment) modTime() (time.Time, error) {
+	fi, err := s.store.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// keep only time index entries for records in the segment
+func (s *segment) trimTimeIndex() {
+	s.timeIndex.Trim(s.nextOffset - s.baseOffset)
+	s.lastTimestamp, _, _ = s.timeIndex.Read(-1)
+	s.lastTimePos = s.store.size
+}
+
+// reports whether the index is missing or older than a non-empty store,
+// in which case it can't be trusted to cover the store's records
+func indexStale(fs FS, storePath, indexPath string) (bool, error) {
+	sfi, err := fs.Stat(storePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if sfi.Size() <= fileHeaderWidth {
+		return false, nil
+	}
+	ifi, err := fs.Stat(indexPath)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return ifi.ModTime().Before(sfi.ModTime()), nil
+}
+
+// regenerates the segment's index by walking the records in its store.
+// unlike recover, the store isn't cut at a record that can't be read
+// back: only the active segment's tail can be torn, elsewhere it's the
+// records after it that would be lost. reading them fails instead.
+func (s *segment) rebuildIndex() (r repair, err error) {
+	s.index.Truncate(0)
+	positions, offsets, end, err := s.walk()
+	if err != nil {
+		return r, err
+	}
+	if err = s.reindex(positions, offsets, &r); err != nil {
+		return r, err
+	}
+	s.damaged = end < s.store.size
+	if s.damaged {
+		s.corruptFrom = s.nextOffset
+		r.unreadableBytes = s.store.size - end
+	}
+	return r, nil
+}
+
+// rebuilds the index of the segment with the given base offset in dir
+// from its store. meant for offline repair, so it fails with ErrLocked
+// while the log in dir is open.
+func RebuildIndex(dir string, baseOffset uint64, c Config) (entries uint64, err error) {
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = 1024
+	}
+	lock, err := lockDir(c.fs(), dir)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	s, err := newSegment(dir, baseOffset, c)
+	if err != nil {
+		return 0, err
+	}
+	r, err := s.rebuildIndex()
+	if err != nil {
+		s.Close()
+		return 0, err
+	}
+	return r.rebuiltEntries, s.Close()
+}
+
+// appends the record, stamped with the time it's appended
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
+	return s.append(record, false)
+}
+
+// appends a record copied from another log, keeping the time it was
+// appended there if it has one
+func (s *segment) Replicate(record *api.Record) (offset uint64, err error) {
+	return s.append(record, true)
+}
+
+func (s *segment) append(record *api.Record, keepTime bool) (offset uint64, err error) {
 	// set record offset
 	cur := s.nextOffset
 	record.Offset = cur
+	// stamp append time
+	now := time.Now()
+	if !keepTime || record.Timestamp == 0 {
+		record.Timestamp = now.UnixNano()
+	}
+	if s.firstAppend.IsZero() {
+		s.firstAppend = now
+	}
+	if err = s.write(record); err != nil {
+		return 0, err
+	}
+	return cur, nil
+}
+
+// writes the record at its own offset, which must be at least the
+// segment's next offset. offsets may be skipped when rewriting a
+// compacted segment.
+func (s *segment) write(record *api.Record) error {
 	// serialize record
 	p, err := proto.Marshal(record)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	// append record to store
 	_, pos, err := s.store.Append(p)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	// append record position to index
 	if err = s.index.Write(
 		// index offsets are relative to segment base offset
-		uint32(s.nextOffset-uint64(s.baseOffset)),
+		uint32(record.Offset-s.baseOffset),
 		pos,
 	); err != nil {
-		return 0, err
+		return err
+	}
+	// index the append time every so many bytes
+	if record.Timestamp > s.lastTimestamp &&
+		(s.timeIndex.size == 0 || pos-s.lastTimePos >= s.config.Segment.TimeIndexIntervalBytes) {
+		// the time index is sparse, so running out of room only slows lookups
+		if err = s.timeIndex.Write(
+			record.Timestamp,
+			uint32(record.Offset-s.baseOffset),
+		); err == nil {
+			s.lastTimestamp = record.Timestamp
+			s.lastTimePos = pos
+		}
 	}
 	// increment offset
-	s.nextOffset++
-	return cur, nil
+	s.nextOffset = record.Offset + 1
+	return nil
 }
 
 func (s *segment) Read(offset uint64) (*api.Record, error) {
 	// get position from index
-	_, pos, err := s.index.Read(int64(offset - s.baseOffset))
-	if err != nil {
-		return nil, err
+	pos, ok := s.index.Find(uint32(offset - s.baseOffset))
+	if !ok {
+		if s.damaged && offset >= s.corruptFrom && offset < s.nextOffset {
+			return nil, api.ErrCorruptRecord{Offset: offset}
+		}
+		if offset < s.nextOffset {
+			return nil, api.ErrOffsetCompacted{Offset: offset}
+		}
+		return nil, io.EOF
 	}
+	return s.readAt(pos, offset)
+}
+
+// reads the record with the given offset stored at pos
+func (s *segment) readAt(pos, offset uint64) (*api.Record, error) {
 	// get record from store
 	p, err := s.store.Read(pos)
+	if isCorrupt(err) {
+		return nil, api.ErrCorruptRecord{Offset: offset}
+	}
 	if err != nil {
 		return nil, err
 	}
 	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	if err = proto.Unmarshal(p, record); err != nil {
+		return nil, api.ErrCorruptRecord{Offset: offset}
+	}
+	// an index that doesn't match its store points at some other record
+	if record.Offset != offset {
+		return nil, api.ErrCorruptRecord{Offset: offset}
+	}
+	return record, nil
+}
+
+// calls fn with each of the segment's records in offset order
+func (s *segment) scan(fn func(*api.Record) error) error {
+	for n := uint64(0); n < s.index.Len(); n++ {
+		off, pos, err := s.index.Read(int64(n))
+		if err != nil {
+			return err
+		}
+		record, err := s.readAt(pos, s.baseOffset+uint64(off))
+		if err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the offset of the first record appended at or after ts,
+// or false if every record in the segment is older
+func (s *segment) OffsetForTime(ts int64) (uint64, bool, error) {
+	// skip the scan when even the newest record is older
+	newest, err := s.NewestTimestamp()
+	if err != nil {
+		return 0, false, err
+	}
+	if newest < ts {
+		return 0, false, nil
+	}
+	// walk the index from the closest time index entry
+	for n := s.index.Search(s.timeIndex.Lookup(ts)); n < s.index.Len(); n++ {
+		off, pos, err := s.index.Read(int64(n))
+		if err != nil {
+			return 0, false, err
+		}
+		record, err := s.readAt(pos, s.baseOffset+uint64(off))
+		if err != nil {
+			return 0, false, err
+		}
+		if record.Timestamp >= ts {
+			return record.Offset, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// describes what recovering a segment changed
+type repair struct {
+	// bytes cut from the end of the store
+	storeBytes uint64
+	// index entries dropped because they didn't match the store
+	droppedEntries uint64
+	// index entries written for records the index was missing
+	rebuiltEntries uint64
+	// bytes left in the store past the last record that could be read
+	unreadableBytes uint64
+}
+
+func (r repair) changed() bool {
+	return r.storeBytes != 0 || r.droppedEntries != 0 || r.rebuiltEntries != 0 ||
+		r.unreadableBytes != 0
+}
+
+// brings the store and index back in line after a crash. the store is cut
+// back to its last complete record and the index is trimmed or rebuilt to
+// point at exactly the records left in the store.
+func (s *segment) recover() (r repair, err error) {
+	positions, offsets, end, err := s.walk()
+	if err != nil {
+		return r, err
+	}
+	if end < s.store.size {
+		r.storeBytes = s.store.size - end
+		if err = s.store.Truncate(end); err != nil {
+			return r, err
+		}
+	}
+	s.damaged = false
+	return r, s.reindex(positions, offsets, &r)
+}
+
+// walks the store for complete records from its start, returning their
+// positions and relative offsets, and the position the walk stopped at
+func (s *segment) walk() (positions []uint64, offsets []uint32, end uint64, err error) {
+	end = s.store.start
+	for end < s.store.size {
+		b, err := s.store.ReadFrame(end)
+		if err == io.EOF || err == errChecksum {
+			break
+		}
+		if err != nil {
+			return nil, nil, end, err
+		}
+		// offsets are read from the records as compaction leaves gaps
+		p, err := s.store.decode(b)
+		// a record that's whole but won't decrypt was written with a
+		// different key, so it isn't cut from the store
+		if err == errDecrypt {
+			return nil, nil, end, err
+		}
+		if err != nil {
+			break
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			break
+		}
+		if record.Offset < s.baseOffset ||
+			(len(offsets) > 0 && record.Offset-s.baseOffset <= uint64(offsets[len(offsets)-1])) {
+			break
+		}
+		positions = append(positions, end)
+		offsets = append(offsets, uint32(record.Offset-s.baseOffset))
+		end += uint64(len(b))
+	}
+	return positions, offsets, end, nil
+}
+
+// points the index at exactly the records at the given positions,
+// keeping the entries that already do, and counts the changes in r
+func (s *segment) reindex(positions []uint64, offsets []uint32, r *repair) error {
+	// keep the index entries that still point at a record
+	var n uint64
+	for ; n < uint64(len(positions)); n++ {
+		off, pos, err := s.index.Read(int64(n))
+		if err != nil || off != offsets[n] || pos != positions[n] {
+			break
+		}
+	}
+	if entries := s.index.Len(); entries > n {
+		r.droppedEntries = entries - n
+	}
+	s.index.Truncate(n)
+	for ; n < uint64(len(positions)); n++ {
+		if err := s.index.Write(offsets[n], positions[n]); err != nil {
+			return err
+		}
+		r.rebuiltEntries++
+	}
+	s.nextOffset = s.baseOffset
+	if n > 0 {
+		s.nextOffset += uint64(offsets[n-1]) + 1
+	}
+	s.trimTimeIndex()
+	return s.loadFirstAppend()
+}
+
+// bytes the segment takes up on disk
+func (s *segment) Size() uint64 {
+	return s.store.size + s.index.size + s.timeIndex.size
+}
+
+// returns the append time of the segment's oldest record
+func (s *segment) OldestTimestamp() (int64, error) {
+	off, pos, err := s.index.Read(0)
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	record, err := s.readAt(pos, s.baseOffset+uint64(off))
+	if err != nil {
+		return 0, err
+	}
+	return record.Timestamp, nil
+}
+
+// returns the append time of the segment's newest record
+func (s *segment) NewestTimestamp() (int64, error) {
+	off, pos, err := s.index.Read(-1)
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	record, err := s.readAt(pos, s.baseOffset+uint64(off))
+	if err != nil {
+		return 0, err
+	}
+	return record.Timestamp, nil
+}
+
+// returns when the segment's newest record was appended, or when its
+// store was last written if the record wasn't stamped
+func (s *segment) newestAppend() (time.Time, error) {
+	newest, err := s.NewestTimestamp()
+	if err != nil || newest != 0 {
+		return time.Unix(0, newest), err
+	}
+	return s.modTime()
 }
 
 // check whether segment has reached max size
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes
+		s.index.size >= s.config.Segment.MaxIndexBytes ||
+		s.IsExpired()
+}
+
+// returns how close the segment is to its size limits, from 0 to 1
+func (s *segment) fill() float64 {
+	fill := float64(s.store.size) / float64(s.config.Segment.MaxStoreBytes)
+	if f := float64(s.index.size) / float64(s.config.Segment.MaxIndexBytes); f > fill {
+		fill = f
+	}
+	if fill > 1 {
+		fill = 1
+	}
+	return fill
+}
+
+// check whether a non-empty segment has been open longer than its max age
+func (s *segment) IsExpired() bool {
+	return s.config.Segment.MaxSegmentAge != 0 &&
+		!s.firstAppend.IsZero() &&
+		time.Since(s.firstAppend) >= s.config.Segment.MaxSegmentAge
 }
 
-// closes the segment and removes index and store fiels
+// removes the segment's files and retires it. the files are unlinked at
+// once so their names can be reused, but readers holding the segment can
+// read them until they release it.
 func (s *segment) Remove() error {
-	if err := s.Close(); err != nil {
+	fs := s.config.fs()
+	if err := fs.Remove(s.index.Name()); err != nil {
 		return err
 	}
-	if err := os.Remove(s.index.Name()); err != nil {
+	if err := fs.Remove(s.store.Name()); err != nil {
 		return err
 	}
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := fs.Remove(s.timeIndex.Name()); err != nil {
 		return err
 	}
+	return s.retire()
+}
+
+// keeps the segment open until it's released, even if it leaves its log
+// in the meantime. the caller must hold the log's lock.
+func (s *segment) acquire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs++
+}
+
+// releases a reference taken with acquire, closing a retired segment
+// once nothing references it
+func (s *segment) release() error {
+	s.mu.Lock()
+	s.refs--
+	last := s.refs == 0 && s.retired
+	s.mu.Unlock()
+	if last {
+		return s.Close()
+	}
 	return nil
 }
 
+// closes a segment that has left its log, or once the readers holding it
+// have released it
+func (s *segment) retire() error {
+	s.mu.Lock()
+	s.retired = true
+	referenced := s.refs > 0
+	s.mu.Unlock()
+	if referenced {
+		return nil
+	}
+	return s.Close()
+}
+
+// reports whether the segment's files are closed
+func (s *segment) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// closes the store before the index so that a cleanly closed
+// index is never older than its store
 func (s *segment) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	if err := s.store.Close(); err != nil {
+		return err
+	}
 	if err := s.index.Close(); err != nil {
 		return err
 	}
-	if err := s.store.Close(); err != nil {
+	if err := s.timeIndex.Close(); err != nil {
 		return err
 	}
 	return nil
@@ -3,7 +3,10 @@ package log
 import (
 	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	api "proglog/api/v1"
 
@@ -11,11 +14,24 @@ import (
 )
 
 func TestSegment(t *testing.T) {
-	dir, _ := os.MkdirTemp("", "segment-test")
-	defer os.RemoveAll(dir)
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"append and read":  testSegmentAppendRead,
+		"recover":          testSegmentRecover,
+		"rebuild index":    testSegmentRebuildIndex,
+		"expire after age": testSegmentExpired,
+	} {
+		for name, newFS := range fileSystems {
+			t.Run(scenario+" in "+name, func(t *testing.T) {
+				c := Config{}
+				c.FS = newFS()
+				fn(t, tempDir(t, c.FS, "segment-test"), c)
+			})
+		}
+	}
+}
 
+func testSegmentAppendRead(t *testing.T, dir string, c Config) {
 	want := &api.Record{Value: []byte("hello world")}
-	c := Config{}
 	c.Segment.MaxStoreBytes = 1024
 	c.Segment.MaxIndexBytes = entWidth * 3
 
@@ -57,3 +73,196 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func testSegmentRecover(t *testing.T, dir string, c Config) {
+	want := &api.Record{Value: []byte("hello world")}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+	// flush the store without closing the segment, as a crash would leave it
+	_, err = s.Read(18)
+	require.NoError(t, err)
+	size := s.store.size
+
+	// tear the tail of the store
+	f, err := c.FS.OpenFile(s.store.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 42, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	// the index is written alongside the store, a store that looks newer
+	// would have it rebuilt rather than recovered
+	fi, err := c.FS.Stat(s.index.Name())
+	require.NoError(t, err)
+	require.NoError(t, chtimes(c.FS, s.store.Name(), fi.ModTime()))
+
+	// the index's unwritten entries are trimmed on open
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), s.index.Len())
+	r, err := s.recover()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), r.storeBytes)
+	require.Equal(t, uint64(0), r.droppedEntries)
+	require.Equal(t, uint64(0), r.rebuiltEntries)
+	require.Equal(t, size, s.store.size)
+	require.Equal(t, uint64(19), s.nextOffset)
+
+	for i := uint64(16); i < 19; i++ {
+		got, err := s.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+	offset, err := s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), offset)
+}
+
+func testSegmentRebuildIndex(t *testing.T, dir string, c Config) {
+	want := &api.Record{Value: []byte("hello world")}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = s.Append(want)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	// missing index
+	require.NoError(t, c.FS.Remove(s.index.Name()))
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), s.nextOffset)
+	got, err := s.Read(18)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+	require.NoError(t, s.Close())
+
+	// stale index
+	f, err := c.FS.OpenFile(s.index.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(int64(entWidth)))
+	require.NoError(t, f.Close())
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, chtimes(c.FS, s.store.Name(), later))
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), s.nextOffset)
+	require.NoError(t, s.Close())
+
+	// offline rebuild, which an open log's lock keeps out
+	lock, err := lockDir(c.FS, dir)
+	require.NoError(t, err)
+	_, err = RebuildIndex(dir, 16, c)
+	require.ErrorIs(t, err, ErrLocked)
+	require.NoError(t, lock.Close())
+	entries, err := RebuildIndex(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), entries)
+
+	// a record that can't be read back is left in the store, along with
+	// the records after it
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	_, pos, err := s.index.Read(2)
+	require.NoError(t, err)
+	size := s.store.size
+	require.NoError(t, s.Close())
+	f, err = c.FS.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(pos)-1)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, c.FS.Remove(s.index.Name()))
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, size, s.store.size)
+	require.Equal(t, uint64(1), s.index.Len())
+	// a sealed segment's next offset is kept by its log
+	s.nextOffset = 19
+	_, err = s.Read(16)
+	require.NoError(t, err)
+	for _, offset := range []uint64{17, 18} {
+		_, err = s.Read(offset)
+		require.Equal(t, api.ErrCorruptRecord{Offset: offset}, err)
+	}
+	require.NoError(t, s.Close())
+}
+
+func testSegmentExpired(t *testing.T, dir string, c Config) {
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.MaxSegmentAge = time.Hour
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	// an empty segment never expires
+	require.False(t, s.IsExpired())
+	_, err = s.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.False(t, s.IsMaxed())
+
+	s.firstAppend = time.Now().Add(-2 * time.Hour)
+	require.True(t, s.IsExpired())
+	require.True(t, s.IsMaxed())
+	require.NoError(t, s.Close())
+
+	// a reopened segment goes by its first record's time
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.False(t, s.IsExpired())
+	require.False(t, s.firstAppend.IsZero())
+}
+
+func TestSegmentOpenFailed(t *testing.T) {
+	for _, ext := range []string{".index", ".timeindex"} {
+		t.Run(ext, func(t *testing.T) {
+			fs := &countingFS{MemFS: NewMemFS()}
+			c := Config{FS: fs}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+			c.Segment.MaxTimeIndexBytes = 1024
+			// a dir in the way of one of the segment's files
+			require.NoError(t, fs.MkdirAll("16"+ext, 0755))
+			_, err := newSegment(".", 16, c)
+			require.Error(t, err)
+			// the files opened before it are closed
+			require.Zero(t, fs.open.Load())
+		})
+	}
+}
+
+// a MemFS that counts the files open in it
+type countingFS struct {
+	*MemFS
+	open atomic.Int64
+}
+
+func (fs *countingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.MemFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fs.open.Add(1)
+	return &countedFile{File: f, fs: fs}, nil
+}
+
+type countedFile struct {
+	File
+	fs    *countingFS
+	close sync.Once
+}
+
+func (f *countedFile) Close() error {
+	f.close.Do(func() { f.fs.open.Add(-1) })
+	return f.File.Close()
+}
@@ -0,0 +1,216 @@
+package log
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// first file in a snapshot, describing the segment files that follow
+const snapshotFile = "snapshot.json"
+
+type snapshot struct {
+	// format version of the segment files
+	Version uint16 `json:"version"`
+	// offset of the first record appended after the snapshot
+	NextOffset uint64            `json:"next_offset"`
+	Segments   []manifestSegment `json:"segments"`
+}
+
+// a segment file, opened while the log was locked, to copy into a snapshot
+type snapshotPart struct {
+	name string
+	file File
+	size int64
+}
+
+// writes a tar archive of the log's segments up to its current next
+// offset, which Restore turns back into a log. appends made while the
+// snapshot is written aren't in it.
+func (l *Log) Snapshot(w io.Writer) error {
+	l.snapshots.RLock()
+	defer l.snapshots.RUnlock()
+	snap, parts, err := l.snapshot()
+	defer func() {
+		for _, p := range parts {
+			p.file.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err = tw.WriteHeader(&tar.Header{
+		Name:    snapshotFile,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: now,
+	}); err != nil {
+		return err
+	}
+	if _, err = tw.Write(b); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if err = tw.WriteHeader(&tar.Header{
+			Name:    p.name,
+			Mode:    0644,
+			Size:    p.size,
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		if _, err = io.CopyN(tw, p.file, p.size); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// opens the log's segment files and notes how much of each is in the
+// snapshot. files are copied from after the lock is released, which is
+// safe as appends only add to them, compaction and retention replace or
+// remove them, and TruncateAfter, which changes them in place, waits for
+// the snapshot. a batch that fails is only cut back to where it started.
+func (l *Log) snapshot() (*snapshot, []snapshotPart, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if !l.Config.ReadOnly {
+		// copy records still in the store's buffer too
+		if err := l.activeSegment.store.Sync(); err != nil {
+			return nil, nil, err
+		}
+	}
+	snap := &snapshot{
+		Version:    formatVersion,
+		NextOffset: l.activeSegment.nextOffset,
+		Segments:   l.manifest().Segments,
+	}
+	var parts []snapshotPart
+	for _, s := range l.segments {
+		for _, f := range []struct {
+			name string
+			size uint64
+		}{
+			{s.store.Name(), s.store.size},
+			{s.index.Name(), fileHeaderWidth + s.index.size},
+			{s.timeIndex.Name(), fileHeaderWidth + s.timeIndex.size},
+		} {
+			file, err := l.Config.fs().OpenFile(f.name, os.O_RDONLY, 0)
+			if err != nil {
+				return nil, parts, err
+			}
+			parts = append(parts, snapshotPart{name: path.Base(f.name), file: file})
+			fi, err := file.Stat()
+			if err != nil {
+				return nil, parts, err
+			}
+			// a file a read-only log found without a header is shorter
+			size := int64(f.size)
+			if fi.Size() < size {
+				size = fi.Size()
+			}
+			parts[len(parts)-1].size = size
+		}
+	}
+	return snap, parts, nil
+}
+
+// creates a log in dir from a snapshot written by Log.Snapshot. dir must
+// not exist or be empty. the snapshot is unpacked next to dir and renamed
+// into place, so a failed restore leaves dir as it was.
+func Restore(r io.Reader, dir string) error {
+	entries, err := os.ReadDir(dir)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("can't restore into %s: not empty", dir)
+	}
+	tmp, err := os.MkdirTemp(path.Dir(dir), path.Base(dir)+".restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return err
+	}
+	if hdr.Name != snapshotFile {
+		return fmt.Errorf("not a log snapshot: starts with %q", hdr.Name)
+	}
+	snap := &snapshot{}
+	if err = json.NewDecoder(tr).Decode(snap); err != nil {
+		return fmt.Errorf("%s: %w", snapshotFile, err)
+	}
+	if snap.Version == 0 || snap.Version > formatVersion {
+		return fmt.Errorf("unsupported segment format version: %d", snap.Version)
+	}
+	// only the files of the segments the snapshot lists are unpacked
+	missing := make(map[string]bool)
+	for _, s := range snap.Segments {
+		for _, ext := range []string{".store", ".index", ".timeindex"} {
+			missing[fmt.Sprintf("%d%s", s.BaseOffset, ext)] = true
+		}
+	}
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !missing[hdr.Name] {
+			return fmt.Errorf("unexpected file in snapshot: %q", hdr.Name)
+		}
+		delete(missing, hdr.Name)
+		if err = restoreFile(path.Join(tmp, hdr.Name), tr); err != nil {
+			return err
+		}
+	}
+	for name := range missing {
+		return fmt.Errorf("snapshot is missing %q", name)
+	}
+	if err = writeManifest(OSFS{}, tmp, &manifest{Segments: snap.Segments}); err != nil {
+		return err
+	}
+	if exists {
+		if err = os.Remove(dir); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tmp, dir); err != nil {
+		return err
+	}
+	return OSFS{}.SyncDir(path.Dir(dir))
+}
+
+// writes a file unpacked from a snapshot to stable storage
+func restoreFile(name string, r io.Reader) error {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,122 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, log.Snapshot(&buf))
+	// appends after the snapshot aren't in it
+	_, err = log.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+
+	restored := path.Join(dir, "restored")
+	require.NoError(t, Restore(bytes.NewReader(buf.Bytes()), restored))
+	n, err := NewLog(restored, c)
+	require.NoError(t, err)
+	defer n.Close()
+	for i := uint64(0); i < 5; i++ {
+		record, err := n.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	highest, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+	off, err := n.Append(&api.Record{Value: []byte("restored")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+
+	// a restore doesn't overwrite a log
+	err = Restore(bytes.NewReader(buf.Bytes()), restored)
+	require.ErrorContains(t, err, "not empty")
+	// nor does it accept other archives
+	err = Restore(bytes.NewReader([]byte("not a snapshot")), path.Join(dir, "other"))
+	require.Error(t, err)
+	_, err = os.Stat(path.Join(dir, "other"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestSnapshotTruncate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	w := &blockingWriter{started: make(chan struct{}), unblock: make(chan struct{})}
+	snapshotted := make(chan error)
+	go func() { snapshotted <- log.Snapshot(w) }()
+	<-w.started
+	// truncating the files being copied waits for the snapshot
+	truncated := make(chan error)
+	go func() { truncated <- log.TruncateAfter(0) }()
+	select {
+	case <-truncated:
+		t.Fatal("truncated the log while a snapshot was copying it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(w.unblock)
+	require.NoError(t, <-snapshotted)
+	require.NoError(t, <-truncated)
+
+	restored := path.Join(dir, "restored")
+	require.NoError(t, Restore(bytes.NewReader(w.Bytes()), restored))
+	n, err := NewLog(restored, c)
+	require.NoError(t, err)
+	defer n.Close()
+	for i := uint64(0); i < 5; i++ {
+		record, err := n.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+}
+
+// blocks the first write until unblock is closed
+type blockingWriter struct {
+	bytes.Buffer
+	started chan struct{}
+	unblock chan struct{}
+	once    sync.Once
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.started)
+		<-w.unblock
+	})
+	return w.Buffer.Write(p)
+}
@@ -0,0 +1,68 @@
+package log
+
+import "time"
+
+// describes the size of a log and what it holds
+type Stats struct {
+	// the log's segments, oldest first. the last is the active segment.
+	Segments []SegmentStats
+	// bytes taken by the segments' stores, and by their indexes and time
+	// indexes
+	StoreBytes uint64
+	IndexBytes uint64
+	// how close the active segment is to rolling, from 0 to 1
+	ActiveFill float64
+	// append times of the oldest and newest records, zero if the log
+	// holds none
+	OldestTime time.Time
+	NewestTime time.Time
+}
+
+type SegmentStats struct {
+	BaseOffset uint64
+	NextOffset uint64
+	StoreBytes uint64
+	IndexBytes uint64
+}
+
+// returns the log's stats
+func (l *Log) Stats() (*Stats, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stats := &Stats{}
+	for _, s := range l.segments {
+		seg := SegmentStats{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StoreBytes: s.store.size,
+			IndexBytes: s.index.size + s.timeIndex.size,
+		}
+		stats.Segments = append(stats.Segments, seg)
+		stats.StoreBytes += seg.StoreBytes
+		stats.IndexBytes += seg.IndexBytes
+	}
+	stats.ActiveFill = l.activeSegment.fill()
+
+	// compaction can leave segments empty, so look past them
+	for _, s := range l.segments {
+		oldest, err := s.OldestTimestamp()
+		if err != nil {
+			return nil, err
+		}
+		if oldest != 0 {
+			stats.OldestTime = time.Unix(0, oldest)
+			break
+		}
+	}
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		newest, err := l.segments[i].NewestTimestamp()
+		if err != nil {
+			return nil, err
+		}
+		if newest != 0 {
+			stats.NewestTime = time.Unix(0, newest)
+			break
+		}
+	}
+	return stats, nil
+}
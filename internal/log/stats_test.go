@@ -0,0 +1,66 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	dir, err := os.MkdirTemp("", "stats-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	stats, err := log.Stats()
+	require.NoError(t, err)
+	require.Len(t, stats.Segments, 1)
+	// only the store's header
+	require.InDelta(t, 0, stats.ActiveFill, 0.01)
+	require.True(t, stats.OldestTime.IsZero())
+	require.True(t, stats.NewestTime.IsZero())
+
+	before := time.Now()
+	for i := 0; i < 4; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	after := time.Now()
+
+	stats, err = log.Stats()
+	require.NoError(t, err)
+	require.Len(t, stats.Segments, 2)
+	var storeBytes, indexBytes uint64
+	for i, want := range [][2]uint64{{0, 3}, {3, 4}} {
+		s := stats.Segments[i]
+		require.Equal(t, want[0], s.BaseOffset)
+		require.Equal(t, want[1], s.NextOffset)
+		require.NotZero(t, s.StoreBytes)
+		require.NotZero(t, s.IndexBytes)
+		storeBytes += s.StoreBytes
+		indexBytes += s.IndexBytes
+	}
+	require.Equal(t, storeBytes, stats.StoreBytes)
+	require.Equal(t, indexBytes, stats.IndexBytes)
+	// one of the active segment's three index entries is used
+	require.InDelta(t, 1.0/3, stats.ActiveFill, 0.01)
+	require.False(t, stats.OldestTime.Before(before.Truncate(time.Nanosecond)))
+	require.False(t, stats.NewestTime.After(after))
+	require.False(t, stats.NewestTime.Before(stats.OldestTime))
+
+	// the oldest time moves on with the records retention removes
+	oldest := stats.OldestTime
+	require.NoError(t, log.Truncate(2))
+	stats, err = log.Stats()
+	require.NoError(t, err)
+	require.Len(t, stats.Segments, 1)
+	require.False(t, stats.OldestTime.Before(oldest))
+}
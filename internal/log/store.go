@@ -2,47 +2,138 @@ package log
 
 import (
 	"bufio"
+	"crypto/cipher"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 var (
 	enc = binary.BigEndian // encoding used to persist record sizes and index entries
+	// table used to checksum records
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	// returned when a record doesn't match its checksum
+	errChecksum = errors.New("record checksum mismatch")
+	// wrapped around the error decoding a record that matches its
+	// checksum, which the length's codec ID isn't covered by
+	errUndecodable = errors.New("record can't be decoded")
+	// returned when writing to a sealed store
+	errSealed = errors.New("store is sealed")
 )
 
 const (
 	lenWidth = 8 // number of bytes used to store the record's length
+	crcWidth = 4 // number of bytes used to store the record's checksum
+	// number of bytes written before every record
+	headerWidth = lenWidth + crcWidth
+	// the length's top byte holds the ID of the record's codec
+	codecShift = 56
+	lenMask    = 1<<codecShift - 1
 )
 
 type store struct {
-	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
-	size uint64
+	File
+	fs FS
+	mu sync.Mutex
+	// held over a sync, so the file isn't swapped out from under it
+	syncMu sync.Mutex
+	buf    *bufio.Writer
+	size   uint64
+	// compresses appended records, nil to leave them uncompressed
+	codec Codec
+	// encrypts the records, nil if the store is in plaintext
+	aead cipher.AEAD
+	// position of the first record, past the header
+	start uint64
+	// the file mapped read-only once the store is sealed
+	mmap atomic.Pointer[[]byte]
 }
 
 // create store for a given file
-func newStore(f *os.File) (*store, error) {
+func newStore(f File, c Config) (*store, error) {
+	// a new store is encrypted with the current key
+	var flags uint16
+	var ext []byte
+	if c.Segment.Keys != nil && !c.ReadOnly {
+		id, _, err := c.Segment.Keys.Current()
+		if err != nil {
+			return nil, err
+		}
+		flags, ext = flagEncrypted, make([]byte, keyIDWidth)
+		enc.PutUint32(ext, id)
+	}
+	flags, err := initHeader(f, storeMagic, flags, ext, c.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	s := &store{
+		File:  f,
+		fs:    c.fs(),
+		buf:   bufio.NewWriter(f),
+		codec: c.Segment.Codec,
+		start: fileHeaderWidth,
+	}
+	if flags&flagEncrypted != 0 {
+		if err = s.initCipher(c.Segment.Keys); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+	}
 	// get file current size in case of recreating the store from a file
-	fi, err := os.Stat(f.Name())
+	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
-	size := uint64(fi.Size())
-	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
-	}, nil
+	s.size = uint64(fi.Size())
+	return s, nil
+}
+
+// loads the key named after the header of an encrypted store
+func (s *store) initCipher(keys KeySource) error {
+	if keys == nil {
+		return ErrNoKeySource
+	}
+	b := make([]byte, keyIDWidth)
+	if _, err := s.File.ReadAt(b, fileHeaderWidth); err != nil {
+		return err
+	}
+	key, err := keys.Key(enc.Uint32(b))
+	if err != nil {
+		return err
+	}
+	if s.aead, err = newAEAD(key); err != nil {
+		return err
+	}
+	s.start += keyIDWidth
+	return nil
 }
 
 // persists the given bytes to the store
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
+	var id uint8
+	if s.codec != nil {
+		id = s.codec.ID()
+		if p, err = s.codec.Compress(p); err != nil {
+			return 0, 0, err
+		}
+	}
+	if s.aead != nil {
+		if p, err = encrypt(s.aead, p); err != nil {
+			return 0, 0, err
+		}
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.mmap.Load() != nil {
+		return 0, 0, errSealed
+	}
 	pos = s.size
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	// write length and checksum ahead of the record
+	if _, err := s.buf.Write(header(p, id)); err != nil {
 		return 0, 0, err
 	}
 	// write to buffered writer
@@ -50,13 +141,73 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	if err != nil {
 		return 0, 0, err
 	}
-	w += lenWidth
+	w += headerWidth
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
 
+// returns the header for a record written with the given codec
+func header(p []byte, codec uint8) []byte {
+	h := make([]byte, headerWidth)
+	enc.PutUint64(h[:lenWidth], uint64(codec)<<codecShift|uint64(len(p)))
+	enc.PutUint32(h[lenWidth:], crc32.Checksum(p, crcTable))
+	return h
+}
+
 // get records stored at the given position
 func (s *store) Read(pos uint64) ([]byte, error) {
+	frame, err := s.ReadFrame(pos)
+	if err != nil {
+		return nil, err
+	}
+	return s.decode(frame)
+}
+
+// returns the decrypted and uncompressed record held in a frame read
+// from the store
+func (s *store) decode(frame []byte) ([]byte, error) {
+	if s.aead == nil {
+		return decode(frame)
+	}
+	p, err := decrypt(s.aead, frame[headerWidth:])
+	if err != nil {
+		return nil, err
+	}
+	return decompress(frame[0], p)
+}
+
+// returns the uncompressed record held in a plaintext frame
+func decode(frame []byte) ([]byte, error) {
+	// the codec ID is the length's top byte
+	return decompress(frame[0], frame[headerWidth:])
+}
+
+// uncompresses p written with the codec with the given ID
+func decompress(id uint8, p []byte) ([]byte, error) {
+	if id == 0 {
+		return p, nil
+	}
+	c, err := codecByID(id)
+	if err == nil {
+		p, err = c.Decompress(p)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUndecodable, err)
+	}
+	return p, nil
+}
+
+// reports whether err means a record read from a store is corrupt
+func isCorrupt(err error) bool {
+	return err == errChecksum || errors.Is(err, errUndecodable)
+}
+
+// get the header and record stored at the given position,
+// verifying the record against its checksum
+func (s *store) ReadFrame(pos uint64) ([]byte, error) {
+	if m := s.mmap.Load(); m != nil {
+		return readMapped(*m, pos)
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	// flush writer buffer
@@ -64,20 +215,158 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 		return nil, err
 	}
 	// find how many bytes we have to read to get the whole record
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+	h := make([]byte, headerWidth)
+	if _, err := s.File.ReadAt(h, int64(pos)); err != nil {
 		return nil, err
 	}
+	size := enc.Uint64(h[:lenWidth]) & lenMask
+	// a length running past the end of the file can't be trusted
+	if size > s.size-pos-headerWidth {
+		return nil, errChecksum
+	}
 	// fetch the record
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+	b := make([]byte, headerWidth+size)
+	copy(b, h)
+	if _, err := s.File.ReadAt(b[headerWidth:], int64(pos+headerWidth)); err != nil {
 		return nil, err
 	}
+	if crc32.Checksum(b[headerWidth:], crcTable) != enc.Uint32(h[lenWidth:]) {
+		return nil, errChecksum
+	}
+	return b, nil
+}
+
+// flushes buffered records and commits the file to stable storage
+func (s *store) Sync() error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	s.mu.Lock()
+	// a sealed store was synced as it was sealed, and takes no writes
+	if s.mmap.Load() != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	err := s.buf.Flush()
+	f := s.File
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// appends can carry on while the file syncs
+	return f.Sync()
+}
+
+// cut the store back to the given size
+func (s *store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mmap.Load() != nil {
+		return errSealed
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+// reads a frame from a sealed store without locking or copying.
+// the returned slice is only valid while the store is open.
+func readMapped(m []byte, pos uint64) ([]byte, error) {
+	if pos+headerWidth > uint64(len(m)) {
+		return nil, io.EOF
+	}
+	size := enc.Uint64(m[pos:pos+lenWidth]) & lenMask
+	if size > uint64(len(m))-pos-headerWidth {
+		return nil, errChecksum
+	}
+	b := m[pos : pos+headerWidth+size]
+	if crc32.Checksum(b[headerWidth:], crcTable) != enc.Uint32(b[lenWidth:headerWidth]) {
+		return nil, errChecksum
+	}
 	return b, nil
 }
 
+// makes the store read-only once its segment has rolled. the file is
+// reopened read-only and mapped into memory, so reads no longer contend
+// with the lock or flush the buffer.
+func (s *store) Seal() error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mmap.Load() != nil {
+		return nil
+	}
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Sync(); err != nil {
+		return err
+	}
+	// an empty file can't be mapped and has nothing to read anyway
+	if s.size == 0 {
+		return nil
+	}
+	f, err := s.fs.OpenFile(s.File.Name(), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	m, err := f.Map()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err = s.File.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	s.File = f
+	s.mmap.Store(&m)
+	return nil
+}
+
+// makes a sealed store writable again, for when the records after its
+// segment are removed and it becomes the active segment once more
+func (s *store) Unseal() error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.mmap.Load()
+	if m == nil {
+		return nil
+	}
+	f, err := s.fs.OpenFile(s.File.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// closing the sealed file unmaps it
+	s.mmap.Store(nil)
+	if err = s.File.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	s.File = f
+	s.buf = bufio.NewWriter(f)
+	return nil
+}
+
 // read len(p) bytes into p beginning at the given offiset
 func (s *store) ReadAt(p []byte, offset int64) (int, error) {
+	if m := s.mmap.Load(); m != nil {
+		if offset >= int64(len(*m)) {
+			return 0, io.EOF
+		}
+		n := copy(p, (*m)[offset:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err := s.buf.Flush(); err != nil {
@@ -88,8 +377,14 @@ func (s *store) ReadAt(p []byte, offset int64) (int, error) {
 
 // persists any buffered data before closing the file
 func (s *store) Close() error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.mmap.Load() != nil {
+		s.mmap.Store(nil)
+		return s.File.Close()
+	}
 	err := s.buf.Flush()
 	if err != nil {
 		return err
@@ -9,48 +9,87 @@ import (
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + headerWidth
 )
 
-func TestStoreAppendRead(t *testing.T) {
-	f, err := os.CreateTemp("", "store_append_read_test")
-	require.NoError(t, err)
-	defer os.Remove(f.Name())
+func TestStore(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, fs FS){
+		"append and read":     testStoreAppendRead,
+		"close flushes":       testStoreClose,
+		"checksum mismatches": testStoreChecksum,
+		"seal maps the file":  testStoreSeal,
+		"sync while sealing":  testStoreSyncSeal,
+	} {
+		for name, newFS := range fileSystems {
+			t.Run(scenario+" in "+name, func(t *testing.T) {
+				fn(t, newFS())
+			})
+		}
+	}
+}
+
+func testStoreAppendRead(t *testing.T, fs FS) {
+	f := createTemp(t, fs, "store_append_read_test")
+	c := Config{}
+	c.FS = fs
 
-	s, err := newStore(f)
+	s, err := newStore(f, c)
 	require.NoError(t, err)
 
 	testAppend(t, s)
 	testRead(t, s)
 	testReadAt(t, s)
 
-	s, err = newStore(f)
+	s, err = newStore(f, c)
 	require.NoError(t, err)
 	testRead(t, s)
 }
 
-func TestStoreClose(t *testing.T) {
-	f, err := os.CreateTemp("", "store_close_test")
-	require.NoError(t, err)
-	defer os.Remove(f.Name())
-	s, err := newStore(f)
+func testStoreClose(t *testing.T, fs FS) {
+	f := createTemp(t, fs, "store_close_test")
+	c := Config{}
+	c.FS = fs
+	s, err := newStore(f, c)
 	require.NoError(t, err)
 	_, _, err = s.Append(write)
 	require.NoError(t, err)
 
-	f, beforeSize, err := openFile(f.Name())
+	f, beforeSize, err := openFile(fs, f.Name())
 	require.NoError(t, err)
 
 	err = s.Close()
 	require.NoError(t, err)
 
-	_, afterSize, err := openFile(f.Name())
+	_, afterSize, err := openFile(fs, f.Name())
 	require.NoError(t, err)
 	require.True(t, afterSize > beforeSize)
 }
 
-func openFile(name string) (file *os.File, size int64, err error) {
-	f, err := os.OpenFile(
+func testStoreChecksum(t *testing.T, fs FS) {
+	f := createTemp(t, fs, "store_checksum_test")
+	c := Config{}
+	c.FS = fs
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	_, err = s.Read(pos)
+	require.NoError(t, err)
+
+	// flip a bit in the record
+	b := make([]byte, 1)
+	_, err = s.ReadAt(b, int64(pos+headerWidth))
+	require.NoError(t, err)
+	b[0] ^= 1
+	_, err = s.File.WriteAt(b, int64(pos+headerWidth))
+	require.NoError(t, err)
+
+	_, err = s.Read(pos)
+	require.Equal(t, errChecksum, err)
+}
+
+func openFile(fs FS, name string) (file File, size int64, err error) {
+	f, err := fs.OpenFile(
 		name,
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		0644,
@@ -70,13 +109,13 @@ func testAppend(t *testing.T, s *store) {
 	for i := uint64(1); i < 4; i++ {
 		n, pos, err := s.Append(write)
 		require.NoError(t, err)
-		require.Equal(t, pos+n, width*i)
+		require.Equal(t, pos+n, fileHeaderWidth+width*i)
 	}
 }
 
 func testRead(t *testing.T, s *store) {
 	t.Helper()
-	var pos uint64
+	pos := uint64(fileHeaderWidth)
 	for i := uint64(1); i < 4; i++ {
 		read, err := s.Read(pos)
 		require.NoError(t, err)
@@ -87,14 +126,14 @@ func testRead(t *testing.T, s *store) {
 
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
-	for i, offset := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, lenWidth)
+	for i, offset := uint64(1), int64(fileHeaderWidth); i < 4; i++ {
+		b := make([]byte, headerWidth)
 		n, err := s.ReadAt(b, offset)
 		require.NoError(t, err)
-		require.Equal(t, lenWidth, n)
+		require.Equal(t, headerWidth, n)
 		offset += int64(n)
 
-		size := enc.Uint64(b)
+		size := enc.Uint64(b[:lenWidth])
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, offset)
 		require.NoError(t, err)
@@ -103,3 +142,54 @@ func testReadAt(t *testing.T, s *store) {
 		offset += int64(n)
 	}
 }
+
+func testStoreSeal(t *testing.T, fs FS) {
+	f := createTemp(t, fs, "store_seal_test")
+	c := Config{}
+	c.FS = fs
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+
+	testAppend(t, s)
+	require.NoError(t, s.Seal())
+	require.NotNil(t, s.mmap.Load())
+	// sealed reads come from the mapped file
+	testRead(t, s)
+	testReadAt(t, s)
+	_, _, err = s.Append(write)
+	require.Equal(t, errSealed, err)
+	require.Equal(t, errSealed, s.Truncate(0))
+
+	require.NoError(t, s.Close())
+	require.Nil(t, s.mmap.Load())
+}
+
+func testStoreSyncSeal(t *testing.T, fs FS) {
+	f := createTemp(t, fs, "store_sync_test")
+	c := Config{}
+	c.FS = fs
+	s, err := newStore(f, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	testAppend(t, s)
+	// sealing and unsealing swap the store's file
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if err := s.Seal(); err != nil {
+				done <- err
+				return
+			}
+			if err := s.Unseal(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, s.Sync())
+	}
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,156 @@
+package log
+
+import (
+	"io"
+)
+
+var (
+	timestampWidth uint64 = 8
+	timeEntWidth          = timestampWidth + offsetWidth
+)
+
+// sparse index of record timestamps. entries contain an append time and
+// the relative offset of the first record appended at that time, and are
+// kept in ascending timestamp order.
+type timeIndex struct {
+	file File
+	mmap []byte
+	size uint64
+	// opened by a read-only log, so the file is never written
+	readOnly bool
+}
+
+// create a time index for a given file
+func newTimeIndex(f File, c Config) (*timeIndex, error) {
+	idx := &timeIndex{
+		file:     f,
+		readOnly: c.ReadOnly,
+	}
+	if _, err := initHeader(f, timeIndexMagic, 0, nil, c.ReadOnly); err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if c.ReadOnly {
+		if fi.Size() <= fileHeaderWidth || c.Segment.MaxTimeIndexBytes == 0 {
+			return idx, nil
+		}
+		idx.size = uint64(fi.Size()) - fileHeaderWidth
+		if idx.mmap, err = f.Map(); err != nil {
+			return nil, err
+		}
+		return idx, nil
+	}
+	idx.size = uint64(fi.Size()) - fileHeaderWidth
+	// a time index with no room is disabled, lookups will scan the store
+	if c.Segment.MaxTimeIndexBytes == 0 {
+		idx.size = 0
+		return idx, nil
+	}
+	// grow the file to max time index size
+	if err = f.Truncate(int64(fileHeaderWidth + c.Segment.MaxTimeIndexBytes)); err != nil {
+		return nil, err
+	}
+	// mmap time index file
+	if idx.mmap, err = f.Map(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// close time index file
+func (t *timeIndex) Close() error {
+	if t.readOnly {
+		return t.file.Close()
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	// truncate file to actual size
+	if err := t.file.Truncate(int64(fileHeaderWidth + t.size)); err != nil {
+		return err
+	}
+	return t.file.Close()
+}
+
+// returns the entry at the given position, or the last entry if in is -1
+func (t *timeIndex) Read(in int64) (ts int64, off uint32, err error) {
+	if t.size == 0 {
+		return 0, 0, io.EOF
+	}
+	var n uint64
+	if in == -1 {
+		n = (t.size / timeEntWidth) - 1
+	} else {
+		n = uint64(in)
+	}
+	pos := n * timeEntWidth
+	if t.size < pos+timeEntWidth {
+		return 0, 0, io.EOF
+	}
+	e := t.entries()
+	ts = int64(enc.Uint64(e[pos : pos+timestampWidth]))
+	off = enc.Uint32(e[pos+timestampWidth : pos+timeEntWidth])
+	return ts, off, nil
+}
+
+// append the given timestamp and relative offset to the time index
+func (t *timeIndex) Write(ts int64, off uint32) error {
+	e := t.entries()
+	if uint64(len(e)) < t.size+timeEntWidth {
+		return io.EOF
+	}
+	enc.PutUint64(e[t.size:t.size+timestampWidth], uint64(ts))
+	enc.PutUint32(e[t.size+timestampWidth:t.size+timeEntWidth], off)
+	t.size += timeEntWidth
+	return nil
+}
+
+// the mapped file past its header
+func (t *timeIndex) entries() []byte {
+	if t.mmap == nil {
+		return nil
+	}
+	return t.mmap[fileHeaderWidth:]
+}
+
+// returns the relative offset of the last entry before ts, which is
+// where a scan for the first record at or after ts should begin
+func (t *timeIndex) Lookup(ts int64) uint32 {
+	// binary search for the first entry at or after ts
+	lo, hi := uint64(0), t.size/timeEntWidth
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if e, _, _ := t.Read(int64(mid)); e < ts {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo == 0 {
+		return 0
+	}
+	_, off, _ := t.Read(int64(lo - 1))
+	return off
+}
+
+// drop trailing entries that are zeroed, out of order, or point at or
+// past the given relative offset, as a crash can leave behind
+func (t *timeIndex) Trim(next uint64) {
+	var n uint64
+	var last int64
+	for ; (n+1)*timeEntWidth <= t.size; n++ {
+		ts, off, _ := t.Read(int64(n))
+		if ts == 0 || ts <= last || uint64(off) >= next {
+			break
+		}
+		last = ts
+	}
+	t.size = n * timeEntWidth
+}
+
+func (t *timeIndex) Name() string {
+	return t.file.Name()
+}
@@ -0,0 +1,77 @@
+package log
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f := createTemp(t, OSFS{}, "timeindex_test")
+
+	c := Config{}
+	c.Segment.MaxTimeIndexBytes = 1024
+	idx, err := newTimeIndex(f, c)
+	require.NoError(t, err)
+	_, _, err = idx.Read(-1)
+	require.Equal(t, io.EOF, err)
+	// nothing indexed, scan from the start
+	require.Equal(t, uint32(0), idx.Lookup(100))
+
+	entries := []struct {
+		Timestamp int64
+		Offset    uint32
+	}{
+		{Timestamp: 100, Offset: 0},
+		{Timestamp: 200, Offset: 4},
+		{Timestamp: 300, Offset: 9},
+	}
+	for i, want := range entries {
+		require.NoError(t, idx.Write(want.Timestamp, want.Offset))
+		ts, off, err := idx.Read(int64(i))
+		require.NoError(t, err)
+		require.Equal(t, want.Timestamp, ts)
+		require.Equal(t, want.Offset, off)
+	}
+	require.Equal(t, uint32(0), idx.Lookup(50))
+	require.Equal(t, uint32(0), idx.Lookup(100))
+	require.Equal(t, uint32(0), idx.Lookup(150))
+	require.Equal(t, uint32(4), idx.Lookup(250))
+	require.Equal(t, uint32(9), idx.Lookup(400))
+
+	// entries past the end of the segment are trimmed
+	idx.Trim(5)
+	ts, off, err := idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, int64(200), ts)
+	require.Equal(t, uint32(4), off)
+	require.NoError(t, idx.Close())
+
+	// time index should build its state from existing file
+	f, _ = OSFS{}.OpenFile(f.Name(), os.O_RDWR, 0600)
+	idx, err = newTimeIndex(f, c)
+	require.NoError(t, err)
+	idx.Trim(10)
+	ts, _, err = idx.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, int64(200), ts)
+}
+
+func TestTimeIndexDefaultSize(t *testing.T) {
+	dir := tempDir(t, OSFS{}, "timeindex-test")
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, uint64(1024), log.Config.Segment.MaxTimeIndexBytes)
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	ts, off, err := log.activeSegment.timeIndex.Read(-1)
+	require.NoError(t, err)
+	require.NotZero(t, ts)
+	require.Equal(t, uint32(0), off)
+}
@@ -0,0 +1,76 @@
+package log
+
+import (
+	api "proglog/api/v1"
+
+	"go.uber.org/zap"
+)
+
+// removes every record after offset, such as the records a follower has
+// that a new leader doesn't. the removal is recorded in the manifest before
+// it starts, so one cut short by a crash is finished on startup.
+func (l *Log) TruncateAfter(offset uint64) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	l.snapshots.Lock()
+	defer l.snapshots.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset+1 >= l.activeSegment.nextOffset {
+		return nil
+	}
+	if offset+1 < l.segments[0].baseOffset {
+		return api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	return l.removeAfter(offset, true)
+}
+
+// records the removal of the records after offset in the manifest and
+// removes them. seen reports whether readers may have read the records.
+// the caller must hold the lock.
+func (l *Log) removeAfter(offset uint64, seen bool) error {
+	m := l.manifest()
+	m.TruncateAfter = &offset
+	if err := writeManifest(l.Config.fs(), l.Dir, m); err != nil {
+		return err
+	}
+	return l.truncateAfter(offset, seen)
+}
+
+// removes the records after offset once the manifest records that it's
+// underway. offset+1 wraps to 0 to remove every record of a log starting
+// at offset 0. readers of the segments are stopped if they may have seen
+// the records. the caller must hold the lock.
+func (l *Log) truncateAfter(offset uint64, seen bool) error {
+	// keep the segment holding offset, or the first if every record goes
+	i := len(l.segments) - 1
+	for i > 0 && l.segments[i].baseOffset >= offset+1 {
+		i--
+	}
+	for _, s := range l.segments[i+1:] {
+		// the records are gone, so iterators mustn't finish reading them
+		if seen {
+			s.gen++
+		}
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	l.segments = l.segments[:i+1]
+	l.activeSegment = l.segments[i]
+	if seen {
+		l.activeSegment.gen++
+	}
+	if err := l.activeSegment.TruncateAfter(offset); err != nil {
+		return err
+	}
+	l.unsynced = 0
+	l.group.truncate(l.activeSegment.nextOffset)
+	l.logger.Info(
+		"truncated log",
+		zap.Uint64("offset", offset),
+		zap.Uint64("next_offset", l.activeSegment.nextOffset),
+	)
+	return l.saveManifest()
+}
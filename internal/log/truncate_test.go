@@ -0,0 +1,121 @@
+package log
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncateAfter(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"within the active segment":         testTruncateAfterActive,
+		"across segments":                   testTruncateAfterSegments,
+		"every record":                      testTruncateAfterAll,
+		"finishes after a crash":            testTruncateAfterCrash,
+		"past the newest record is a no-op": testTruncateAfterNoop,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "truncate-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 2
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for i := 0; i < 7; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("before")})
+				require.NoError(t, err)
+			}
+			fn(t, log)
+		})
+	}
+}
+
+// checks that offset is the newest record and the log carries on after it
+func requireTruncated(t *testing.T, log *Log, offset uint64) {
+	t.Helper()
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, offset, highest)
+	_, err = log.Read(offset + 1)
+	require.Error(t, err)
+
+	next, err := log.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, offset+1, next)
+	record, err := log.Read(next)
+	require.NoError(t, err)
+	require.Equal(t, []byte("after"), record.Value)
+}
+
+func testTruncateAfterActive(t *testing.T, log *Log) {
+	// the active segment holds offset 6 alone
+	_, err := log.Append(&api.Record{Value: []byte("before")})
+	require.NoError(t, err)
+	require.NoError(t, log.TruncateAfter(6))
+	requireTruncated(t, log, 6)
+}
+
+func testTruncateAfterSegments(t *testing.T, log *Log) {
+	require.NoError(t, log.TruncateAfter(2))
+	require.Len(t, log.segments, 2)
+	_, err := os.Stat(path.Join(log.Dir, "4.store"))
+	require.True(t, os.IsNotExist(err))
+	requireTruncated(t, log, 2)
+
+	// the truncation survives reopening the log
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	highest, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), highest)
+	record, err := n.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("after"), record.Value)
+}
+
+func testTruncateAfterAll(t *testing.T, log *Log) {
+	require.NoError(t, log.Truncate(1))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	require.Error(t, log.TruncateAfter(0))
+
+	require.NoError(t, log.TruncateAfter(1))
+	require.Len(t, log.segments, 1)
+	_, err = log.Read(2)
+	require.Error(t, err)
+	off, err := log.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func testTruncateAfterCrash(t *testing.T, log *Log) {
+	// the log stopped after recording the truncation but before doing it
+	m := log.manifest()
+	offset := uint64(2)
+	m.TruncateAfter = &offset
+	require.NoError(t, log.Close())
+	require.NoError(t, writeManifest(OSFS{}, log.Dir, m))
+
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	requireTruncated(t, n, 2)
+	m, err = readManifest(OSFS{}, n.Dir)
+	require.NoError(t, err)
+	require.Nil(t, m.TruncateAfter)
+}
+
+func testTruncateAfterNoop(t *testing.T, log *Log) {
+	require.NoError(t, log.TruncateAfter(6))
+	require.NoError(t, log.TruncateAfter(100))
+	requireTruncated(t, log, 6)
+}
@@ -0,0 +1,232 @@
+package log
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	api "proglog/api/v1"
+
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// directory in the log's dir that legacy segments are rewritten in
+const upgradeDir = "upgrade"
+
+// rewrites the segments in dir that were written before segment files had
+// a format header into the current format, and returns the base offsets of
+// the segments it upgraded. records keep their offsets. fails with
+// ErrLocked while the log in dir is open.
+func Upgrade(dir string, c Config) ([]uint64, error) {
+	lock, err := lockDir(c.fs(), dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	files, err := c.fs().ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var baseOffsets []uint64
+	for _, file := range files {
+		if file.IsDir() || path.Ext(file.Name()) != ".store" {
+			continue
+		}
+		offset, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".store"), 10, 0)
+		if err != nil {
+			continue
+		}
+		baseOffsets = append(baseOffsets, offset)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	var upgraded []uint64
+	for _, baseOffset := range baseOffsets {
+		ok, err := upgradeSegment(dir, baseOffset, c)
+		if err != nil {
+			return upgraded, err
+		}
+		if ok {
+			upgraded = append(upgraded, baseOffset)
+		}
+	}
+	return upgraded, nil
+}
+
+// upgrades the segment with the given base offset, reporting whether it
+// had anything to upgrade
+func upgradeSegment(dir string, baseOffset uint64, c Config) (bool, error) {
+	fs := c.fs()
+	storePath := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store"))
+	legacy, err := isLegacy(fs, storePath, storeMagic)
+	if err != nil {
+		return false, err
+	}
+	if !legacy {
+		// a crash can leave an upgraded store next to legacy indexes,
+		// which are removed and rebuilt from the store
+		var removed bool
+		for ext, magic := range map[string][]byte{".index": indexMagic, ".timeindex": timeIndexMagic} {
+			p := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ext))
+			legacy, err := isLegacy(fs, p, magic)
+			if err != nil {
+				return false, err
+			}
+			if !legacy {
+				continue
+			}
+			if err = fs.Remove(p); err != nil {
+				return false, err
+			}
+			removed = true
+		}
+		if !removed {
+			return false, nil
+		}
+		s, err := newSegment(dir, baseOffset, c)
+		if err != nil {
+			return false, err
+		}
+		return true, s.Close()
+	}
+	b, err := readFile(fs, storePath)
+	if err != nil {
+		return false, err
+	}
+	records, n := parseLegacyStore(b, baseOffset)
+	if n == 0 && len(b) > 0 {
+		return false, fmt.Errorf("%s: unrecognized store format", storePath)
+	}
+	if n < len(b) {
+		zap.L().Named("log").Warn(
+			"dropped legacy store tail",
+			zap.String("store", storePath),
+			zap.Int("store_bytes_truncated", len(b)-n),
+		)
+	}
+	tmp := path.Join(dir, upgradeDir)
+	// clear out anything left by a crashed upgrade
+	if err = fs.RemoveAll(tmp); err != nil {
+		return false, err
+	}
+	if err = fs.MkdirAll(tmp, 0755); err != nil {
+		return false, err
+	}
+	defer fs.RemoveAll(tmp)
+	// the index has to fit every record the segment already holds
+	if need := uint64(len(records)) * entWidth; c.Segment.MaxIndexBytes < need {
+		c.Segment.MaxIndexBytes = need
+	}
+	s, err := newSegment(tmp, baseOffset, c)
+	if err != nil {
+		return false, err
+	}
+	for _, record := range records {
+		if err = s.write(record); err != nil {
+			s.Close()
+			return false, err
+		}
+	}
+	if err = s.Close(); err != nil {
+		return false, err
+	}
+	// the store is replaced first. if the indexes aren't replaced before
+	// a crash, upgrading again rebuilds them from the new store.
+	for _, ext := range []string{".store", ".index", ".timeindex"} {
+		name := fmt.Sprintf("%d%s", baseOffset, ext)
+		if err = fs.Rename(path.Join(tmp, name), path.Join(dir, name)); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// reports whether the file at p was written before files had a header
+func isLegacy(fs FS, p string, magic []byte) (bool, error) {
+	f, err := fs.OpenFile(p, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := make([]byte, fileHeaderWidth)
+	// too short for a header is a file that's new or was never written
+	if _, err = io.ReadFull(f, h); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = parseHeader(h, magic)
+	if err == ErrLegacyFormat {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", p, err)
+	}
+	return false, nil
+}
+
+// parses the records of a headerless store, returning them and how many
+// bytes of the store they took. stores were written with checksums and
+// codecs before they had headers, and with only a length before that, so
+// both framings are tried and the one that parses more of the store wins.
+func parseLegacyStore(b []byte, baseOffset uint64) ([]*api.Record, int) {
+	records, n := parseLegacyRecords(b, baseOffset, true)
+	if plain, m := parseLegacyRecords(b, baseOffset, false); m > n {
+		return plain, m
+	}
+	return records, n
+}
+
+// parses records from the start of b until one doesn't parse
+func parseLegacyRecords(b []byte, baseOffset uint64, checksums bool) (records []*api.Record, n int) {
+	width := uint64(lenWidth)
+	if checksums {
+		width = headerWidth
+	}
+	for {
+		rest := b[n:]
+		if uint64(len(rest)) < width {
+			return records, n
+		}
+		size := enc.Uint64(rest[:lenWidth])
+		if checksums {
+			size &= lenMask
+		}
+		if size > uint64(len(rest))-width {
+			return records, n
+		}
+		frame := rest[:width+size]
+		p := frame[width:]
+		if checksums {
+			if crc32.Checksum(p, crcTable) != enc.Uint32(frame[lenWidth:]) {
+				return records, n
+			}
+			var err error
+			if p, err = decode(frame); err != nil {
+				return records, n
+			}
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return records, n
+		}
+		// offsets only ever grow, so anything else was misparsed
+		if record.Offset < baseOffset ||
+			(len(records) > 0 && record.Offset <= records[len(records)-1].Offset) {
+			return records, n
+		}
+		records = append(records, record)
+		n += len(frame)
+	}
+}
@@ -0,0 +1,109 @@
+package log
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"testing"
+
+	api "proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestUpgrade(t *testing.T) {
+	for scenario, checksums := range map[string]bool{
+		"checksummed store": true,
+		"length only store": false,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "upgrade-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			writeLegacySegment(t, dir, 0, 3, checksums)
+			writeLegacySegment(t, dir, 3, 2, checksums)
+
+			c := Config{}
+			c.Segment.MaxIndexBytes = 1024
+			_, err = NewLog(dir, c)
+			require.ErrorIs(t, err, ErrLegacyFormat)
+
+			upgraded, err := Upgrade(dir, c)
+			require.NoError(t, err)
+			require.Equal(t, []uint64{0, 3}, upgraded)
+			// upgrading again has nothing to do
+			upgraded, err = Upgrade(dir, c)
+			require.NoError(t, err)
+			require.Empty(t, upgraded)
+
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			// an open log can't be upgraded under it
+			_, err = Upgrade(dir, c)
+			require.ErrorIs(t, err, ErrLocked)
+			for i := uint64(0); i < 5; i++ {
+				record, err := log.Read(i)
+				require.NoError(t, err)
+				require.Equal(t, i, record.Offset)
+				require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+			}
+			off, err := log.Append(&api.Record{Value: []byte("after")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(5), off)
+		})
+	}
+}
+
+func TestUpgradeLegacyIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "upgrade-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a crash mid upgrade leaves the new store next to the legacy index
+	writeLegacySegment(t, dir, 0, 3, true)
+	index, err := os.ReadFile(path.Join(dir, "0.index"))
+	require.NoError(t, err)
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	_, err = Upgrade(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path.Join(dir, "0.index"), index, 0644))
+
+	upgraded, err := Upgrade(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0}, upgraded)
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, uint64(3), s.nextOffset)
+	record, err := s.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 2"), record.Value)
+}
+
+// writes a segment the way it was written before files had headers
+func writeLegacySegment(t *testing.T, dir string, baseOffset, n uint64, checksums bool) {
+	t.Helper()
+	var store, index []byte
+	for i := uint64(0); i < n; i++ {
+		p, err := proto.Marshal(&api.Record{
+			Value:  []byte(fmt.Sprintf("record %d", baseOffset+i)),
+			Offset: baseOffset + i,
+		})
+		require.NoError(t, err)
+		index = enc.AppendUint32(index, uint32(i))
+		index = enc.AppendUint64(index, uint64(len(store)))
+		store = enc.AppendUint64(store, uint64(len(p)))
+		if checksums {
+			store = enc.AppendUint32(store, crc32.Checksum(p, crcTable))
+		}
+		store = append(store, p...)
+	}
+	require.NoError(t, os.WriteFile(path.Join(dir, fmt.Sprintf("%d.store", baseOffset)), store, 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, fmt.Sprintf("%d.index", baseOffset)), index, 0644))
+}
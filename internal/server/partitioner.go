@@ -0,0 +1,37 @@
+package server
+
+import (
+	"hash/fnv"
+	api "proglog/api/v1"
+	"sync/atomic"
+)
+
+// picks the partition of a record produced without one
+type Partitioner interface {
+	Partition(record *api.Record, partitions uint32) uint32
+}
+
+// spreads records evenly across partitions in turn
+type RoundRobinPartitioner struct {
+	next atomic.Uint32
+}
+
+func (p *RoundRobinPartitioner) Partition(_ *api.Record, partitions uint32) uint32 {
+	return (p.next.Add(1) - 1) % partitions
+}
+
+// sends records with the same key to the same partition, so they're
+// consumed in the order they were produced. records without a key are
+// spread round-robin.
+type KeyHashPartitioner struct {
+	keyless RoundRobinPartitioner
+}
+
+func (p *KeyHashPartitioner) Partition(record *api.Record, partitions uint32) uint32 {
+	if len(record.GetKey()) == 0 {
+		return p.keyless.Partition(record, partitions)
+	}
+	h := fnv.New32a()
+	h.Write(record.GetKey())
+	return h.Sum32() % partitions
+}
@@ -1,8 +1,11 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"io"
 	api "proglog/api/v1"
+	"proglog/internal/log"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
@@ -28,7 +31,129 @@ import (
 
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	// appends a record keeping its timestamp, for replication
+	Replicate(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) (uint64, uint64, error)
 	Read(uint64) (*api.Record, error)
+	OffsetForTime(time.Time) (uint64, error)
+	// returns an iterator from the given offset that waits at the end of
+	// the log for records to be appended
+	Iterator(from uint64) Iterator
+	// describes the log's segments and what they hold
+	LogInfo() (*api.GetLogInfoResponse, error)
+}
+
+// reads a log's records in offset order
+type Iterator interface {
+	// returns the next record, or io.EOF once the iterator is closed
+	Next() (*api.Record, error)
+	// stops the iterator, waking a call to Next. safe to call while
+	// Next is running.
+	Close() error
+}
+
+// serves a log.Log as a CommitLog
+func NewCommitLog(l *log.Log) CommitLog {
+	return commitLog{l}
+}
+
+type commitLog struct {
+	*log.Log
+}
+
+func (l commitLog) Iterator(from uint64) Iterator {
+	it := l.Log.Iterator(from)
+	it.Block = true
+	return it
+}
+
+func (l commitLog) LogInfo() (*api.GetLogInfoResponse, error) {
+	stats, err := l.Stats()
+	if err != nil {
+		return nil, err
+	}
+	res := &api.GetLogInfoResponse{
+		StoreBytes: stats.StoreBytes,
+		IndexBytes: stats.IndexBytes,
+		ActiveFill: stats.ActiveFill,
+	}
+	if !stats.OldestTime.IsZero() {
+		res.OldestTime = stats.OldestTime.UnixNano()
+		res.NewestTime = stats.NewestTime.UnixNano()
+	}
+	for _, s := range stats.Segments {
+		res.Segments = append(res.Segments, &api.SegmentInfo{
+			BaseOffset: s.BaseOffset,
+			NextOffset: s.NextOffset,
+			StoreBytes: s.StoreBytes,
+			IndexBytes: s.IndexBytes,
+		})
+	}
+	return res, nil
+}
+
+// routes requests to the logs of their topic's partitions
+type TopicManager interface {
+	// returns the number of partitions of the topic, creating the topic
+	// first if create is set. the empty topic is the default topic.
+	Partitions(topic string, create bool) (uint32, error)
+	CommitLog(topic string, partition uint32) (CommitLog, error)
+	// creates the topic with the given number of partitions, 0 for the
+	// default. reports false if the topic already existed.
+	CreateTopic(topic string, partitions uint32) (bool, error)
+	ListTopics() []*api.TopicInfo
+}
+
+// serves the topics of a log.Manager as a TopicManager
+func NewTopicManager(m *log.Manager) TopicManager {
+	return topicManager{m}
+}
+
+type topicManager struct {
+	*log.Manager
+}
+
+func (m topicManager) Partitions(topic string, create bool) (uint32, error) {
+	get := m.Topic
+	if create {
+		get = func(topic string) (*log.Topic, error) {
+			t, _, err := m.Manager.CreateTopic(topic, 0)
+			return t, err
+		}
+	}
+	t, err := get(topic)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(len(t.Partitions)), nil
+}
+
+func (m topicManager) CommitLog(topic string, partition uint32) (CommitLog, error) {
+	t, err := m.Topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	l, err := t.Partition(partition)
+	if err != nil {
+		return nil, err
+	}
+	return NewCommitLog(l), nil
+}
+
+func (m topicManager) CreateTopic(topic string, partitions uint32) (bool, error) {
+	_, created, err := m.Manager.CreateTopic(topic, partitions)
+	return created, err
+}
+
+func (m topicManager) ListTopics() []*api.TopicInfo {
+	var topics []*api.TopicInfo
+	for _, t := range m.Manager.ListTopics() {
+		topics = append(topics, &api.TopicInfo{
+			Name:       t.Name,
+			Partitions: uint32(len(t.Partitions)),
+		})
+	}
+	return topics
 }
 
 type Authorizer interface {
@@ -36,8 +161,13 @@ type Authorizer interface {
 }
 
 type Config struct {
+	// serves every request when there are no Topics
 	CommitLog  CommitLog
+	Topics     TopicManager
 	Authorizer Authorizer
+	// picks the partition of records produced without one, by key hash
+	// when unset
+	Partitioner Partitioner
 }
 
 type grpcServer struct {
@@ -51,10 +181,14 @@ const (
 	objectWildcard = "*"
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	adminAction    = "admin"
 )
 
 var _ api.LogServer = (*grpcServer)(nil)
 
+// returned by the admin calls of a server with a single log
+var errNoTopics = status.Error(codes.Unimplemented, "server has no topics")
+
 func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
 	// configure zap
 	logger := zap.L().Named("server")
@@ -102,12 +236,49 @@ func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 }
 
 func newGrpcServer(config *Config) (srv *grpcServer, err error) {
+	if config.Partitioner == nil {
+		config.Partitioner = &KeyHashPartitioner{}
+	}
 	srv = &grpcServer{Config: config}
 	return srv, nil
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	offset, err := s.CommitLog.Append(req.Record)
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		produceAction,
+	); err != nil {
+		return nil, err
+	}
+	// only the servers replicating records get to keep their timestamps
+	if req.KeepTimestamp {
+		if err := s.Authorizer.Authorize(
+			subject(ctx),
+			objectWildcard,
+			adminAction,
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	clog, partition, err := s.produceLog(req.Topic, req.Partition, []*api.Record{req.Record})
+	if err != nil {
+		return nil, err
+	}
+	appendFn := clog.Append
+	if req.KeepTimestamp {
+		appendFn = clog.Replicate
+	}
+	offset, err := appendFn(req.Record)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ProduceResponse{Offset: offset, Partition: partition}, nil
+}
+
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
 	if err := s.Authorizer.Authorize(
 		subject(ctx),
 		objectWildcard,
@@ -116,11 +287,24 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 		return nil, err
 	}
 
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "batch has no records")
+	}
+
+	clog, partition, err := s.produceLog(req.Topic, req.Partition, req.Records)
+	if err != nil {
+		return nil, err
+	}
+	first, last, err := clog.AppendBatch(req.Records)
 	if err != nil {
 		return nil, err
 	}
 
-	return &api.ProduceResponse{Offset: offset}, nil
+	return &api.ProduceBatchResponse{
+		FirstOffset: first,
+		LastOffset:  last,
+		Partition:   partition,
+	}, nil
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
@@ -132,7 +316,19 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 		return nil, err
 	}
 
-	record, err := s.CommitLog.Read(req.Offset)
+	clog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	offset := req.Offset
+	if req.StartTime != 0 {
+		offset, err = clog.OffsetForTime(time.Unix(0, req.StartTime))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	record, err := clog.Read(offset)
 	if err != nil {
 		return nil, err
 	}
@@ -157,25 +353,157 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 }
 
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	ctx := stream.Context()
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return err
+	}
+
+	clog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+	// resolve the start time once, the stream then follows offsets
+	offset := req.Offset
+	if req.StartTime != 0 {
+		offset, err = clog.OffsetForTime(time.Unix(0, req.StartTime))
+		if err != nil {
+			return err
+		}
+	}
+	it := clog.Iterator(offset)
+	defer it.Close()
+	// wake the iterator once the consumer goes away
+	go func() {
+		<-ctx.Done()
+		it.Close()
+	}()
 	for {
-		select {
-		case <-stream.Context().Done():
+		record, err := it.Next()
+		if err == io.EOF {
 			return nil
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
-				return err
-			}
-			if err = stream.Send(res); err != nil {
-				return err
-			}
-			req.Offset++
+		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *grpcServer) CreateTopic(ctx context.Context, req *api.CreateTopicRequest) (*api.CreateTopicResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		adminAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, errNoTopics
+	}
+	created, err := s.Topics.CreateTopic(req.Topic, req.Partitions)
+	if err != nil {
+		return nil, err
+	}
+	return &api.CreateTopicResponse{Created: created}, nil
+}
+
+func (s *grpcServer) ListTopics(ctx context.Context, req *api.ListTopicsRequest) (*api.ListTopicsResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		adminAction,
+	); err != nil {
+		return nil, err
+	}
+	if s.Topics == nil {
+		return nil, errNoTopics
+	}
+	return &api.ListTopicsResponse{Topics: s.Topics.ListTopics()}, nil
+}
+
+func (s *grpcServer) GetLogInfo(ctx context.Context, req *api.GetLogInfoRequest) (*api.GetLogInfoResponse, error) {
+	if err := s.Authorizer.Authorize(
+		subject(ctx),
+		objectWildcard,
+		consumeAction,
+	); err != nil {
+		return nil, err
+	}
+
+	clog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return clog.LogInfo()
+}
+
+// returns the log serving the topic's partition
+func (s *grpcServer) commitLog(topic string, partition uint32) (CommitLog, error) {
+	if s.Topics != nil {
+		return s.Topics.CommitLog(topic, partition)
+	}
+	if topic != "" {
+		return nil, api.ErrTopicNotFound{Topic: topic}
+	}
+	if partition != 0 {
+		return nil, api.ErrPartitionNotFound{Topic: topic, Partition: partition}
+	}
+	return s.CommitLog, nil
+}
+
+// returns the log to append record to and its partition, creating the
+// topic if it doesn't exist. the partitioner picks the partition when
+// the request doesn't.
+func (s *grpcServer) produceLog(
+	topic string,
+	partition *uint32,
+	records []*api.Record,
+) (CommitLog, uint32, error) {
+	partitions := uint32(1)
+	if s.Topics != nil {
+		var err error
+		if partitions, err = s.Topics.Partitions(topic, true); err != nil {
+			return nil, 0, err
+		}
+	}
+	var p uint32
+	if partition != nil {
+		p = *partition
+	} else if partitions > 1 {
+		record, err := batchKey(records)
+		if err != nil {
+			return nil, 0, err
+		}
+		p = s.Partitioner.Partition(record, partitions)
+	}
+	clog, err := s.commitLog(topic, p)
+	return clog, p, err
+}
+
+// returns the record a batch is partitioned by: its first keyed record, or
+// its first record if none has a key. the whole batch goes to one
+// partition, so its keyed records must share their key.
+func batchKey(records []*api.Record) (*api.Record, error) {
+	record := records[0]
+	for _, r := range records {
+		switch {
+		case len(r.Key) == 0:
+		case len(record.Key) == 0:
+			record = r
+		case !bytes.Equal(r.Key, record.Key):
+			return nil, status.Error(
+				codes.InvalidArgument,
+				"batch has records with different keys, give it a partition",
+			)
 		}
 	}
+	return record, nil
 }
 
 func authenticate(ctx context.Context) (context.Context, error) {
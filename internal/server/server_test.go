@@ -3,12 +3,14 @@ package server
 import (
 	"context"
 	"flag"
+	"io"
 	"net"
 	"os"
 	api "proglog/api/v1"
 	"proglog/internal/auth"
 	"proglog/internal/config"
 	"proglog/internal/log"
+	"sync"
 	"testing"
 	"time"
 
@@ -41,6 +43,10 @@ func TestServer(t *testing.T) {
 		"consume past log boundary fails":                testConsumePastBoundary,
 		"produce/consume stream succeeds":                testProduceConsumeStream,
 		"unauthorized fails":                             testUnauthorized,
+		"consume from a start time succeeds":             testConsumeStartTime,
+		"produce stamps the append time":                 testProduceTimestamp,
+		"produce batch succeeds":                         testProduceBatch,
+		"get log info succeeds":                          testGetLogInfo,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient, nobodyClient, config, teardown := setupTest(t, nil)
@@ -77,7 +83,7 @@ func setupTest(t *testing.T, fn func(*Config)) (rootClient api.LogClient, nobody
 	// create server
 	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
 	cfg = &Config{
-		CommitLog:  clog,
+		CommitLog:  NewCommitLog(clog),
 		Authorizer: authorizer,
 	}
 	// config telemetry
@@ -226,10 +232,9 @@ func testProduceConsumeStream(t *testing.T, client api.LogClient, nobodyClient a
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
-			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
-			})
+			require.Equal(t, record.Value, res.Record.Value)
+			require.Equal(t, uint64(i), res.Record.Offset)
+			require.NotZero(t, res.Record.Timestamp)
 		}
 	}
 }
@@ -257,3 +262,370 @@ func testUnauthorized(t *testing.T, _, nobodyClient api.LogClient, config *Confi
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
 }
+
+func testConsumeStartTime(t *testing.T, client api.LogClient, nobodyClient api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("before")},
+	})
+	require.NoError(t, err)
+	start := time.Now()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("after")},
+	})
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		StartTime: start.UnixNano(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset, consume.Record.Offset)
+	require.Equal(t, []byte("after"), consume.Record.Value)
+}
+
+func testProduceTimestamp(t *testing.T, client api.LogClient, nobodyClient api.LogClient, config *Config) {
+	ctx := context.Background()
+	old := time.Now().Add(-time.Hour).UnixNano()
+	start := time.Now()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world"), Timestamp: old},
+	})
+	require.NoError(t, err)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.False(t, time.Unix(0, consume.Record.Timestamp).Before(start))
+
+	// replicated records keep the time of their origin
+	produce, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:        &api.Record{Value: []byte("hello world"), Timestamp: old},
+		KeepTimestamp: true,
+	})
+	require.NoError(t, err)
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, old, consume.Record.Timestamp)
+}
+
+func testProduceBatch(t *testing.T, client api.LogClient, nobodyClient api.LogClient, config *Config) {
+	ctx := context.Background()
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+		{Value: []byte("third message")},
+	}
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.FirstOffset)
+	require.Equal(t, uint64(2), produce.LastOffset)
+
+	for i, record := range records {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: uint64(i)})
+		require.NoError(t, err)
+		require.Equal(t, record.Value, consume.Record.Value)
+	}
+
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = nobodyClient.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testGetLogInfo(t *testing.T, client api.LogClient, nobodyClient api.LogClient, config *Config) {
+	ctx := context.Background()
+	info, err := client.GetLogInfo(ctx, &api.GetLogInfoRequest{})
+	require.NoError(t, err)
+	require.Len(t, info.Segments, 1)
+	require.Zero(t, info.OldestTime)
+
+	start := time.Now()
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{
+			{Value: []byte("first message")},
+			{Value: []byte("second message")},
+		},
+	})
+	require.NoError(t, err)
+	info, err = client.GetLogInfo(ctx, &api.GetLogInfoRequest{})
+	require.NoError(t, err)
+	require.Len(t, info.Segments, 1)
+	require.Equal(t, uint64(2), info.Segments[0].NextOffset)
+	require.Equal(t, info.Segments[0].StoreBytes, info.StoreBytes)
+	require.NotZero(t, info.IndexBytes)
+	require.Greater(t, info.ActiveFill, float64(0))
+	require.GreaterOrEqual(t, info.OldestTime, start.UnixNano())
+	require.GreaterOrEqual(t, info.NewestTime, info.OldestTime)
+
+	_, err = client.GetLogInfo(ctx, &api.GetLogInfoRequest{Topic: "missing"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = nobodyClient.GetLogInfo(ctx, &api.GetLogInfoRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestServerTopics(t *testing.T) {
+	dir, err := os.MkdirTemp("", "server-topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	manager, err := log.NewManager(dir, log.Config{}, nil)
+	require.NoError(t, err)
+	defer manager.Close()
+
+	client, nobodyClient, _, teardown := setupTest(t, func(c *Config) {
+		c.Topics = NewTopicManager(manager)
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// topics are created on produce and kept apart
+	for _, topic := range []string{"", "orders"} {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Topic:  topic,
+			Record: &api.Record{Value: []byte("to " + topic)},
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), produce.Offset)
+	}
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("to orders"), consume.Record.Value)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "missing"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Topic:  "../escape",
+		Record: &api.Record{Value: []byte("nope")},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	created, err := client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Topic:      "payments",
+		Partitions: 3,
+	})
+	require.NoError(t, err)
+	require.True(t, created.Created)
+	topics, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Len(t, topics.Topics, 3)
+	for i, want := range []*api.TopicInfo{
+		{Name: log.DefaultTopic, Partitions: 1},
+		{Name: "orders", Partitions: 1},
+		{Name: "payments", Partitions: 3},
+	} {
+		require.Equal(t, want.Name, topics.Topics[i].Name)
+		require.Equal(t, want.Partitions, topics.Topics[i].Partitions)
+	}
+
+	// records go to the partition asked for
+	partition := uint32(2)
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Topic:     "payments",
+		Partition: &partition,
+		Record:    &api.Record{Value: []byte("to partition 2")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, partition, produce.Partition)
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{
+		Topic:     "payments",
+		Partition: partition,
+		Offset:    produce.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte("to partition 2"), consume.Record.Value)
+	partition = 3
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Topic:     "payments",
+		Partition: &partition,
+		Record:    &api.Record{Value: []byte("nope")},
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// or else to the same partition for the same key
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Topic: "payments",
+		Records: []*api.Record{
+			{Value: []byte("no key")},
+			{Key: []byte("alice"), Value: []byte("first")},
+		},
+	})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		produce, err = client.Produce(ctx, &api.ProduceRequest{
+			Topic:  "payments",
+			Record: &api.Record{Key: []byte("alice"), Value: []byte("next")},
+		})
+		require.NoError(t, err)
+		require.Equal(t, batch.Partition, produce.Partition)
+	}
+	// a batch can't be split between the partitions of its keys
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Topic: "payments",
+		Records: []*api.Record{
+			{Key: []byte("alice"), Value: []byte("next")},
+			{Key: []byte("bob"), Value: []byte("first")},
+		},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = nobodyClient.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "nobody"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestPartitioner(t *testing.T) {
+	rr := &RoundRobinPartitioner{}
+	for i := uint32(0); i < 6; i++ {
+		require.Equal(t, i%3, rr.Partition(&api.Record{}, 3))
+	}
+
+	kh := &KeyHashPartitioner{}
+	alice := kh.Partition(&api.Record{Key: []byte("alice")}, 8)
+	require.Less(t, alice, uint32(8))
+	require.Equal(t, alice, kh.Partition(&api.Record{Key: []byte("alice")}, 8))
+	// keyless records are spread round-robin
+	seen := make(map[uint32]bool)
+	for i := 0; i < 4; i++ {
+		seen[kh.Partition(&api.Record{}, 4)] = true
+	}
+	require.Len(t, seen, 4)
+}
+
+// the server needs nothing of a log but the CommitLog interface
+func TestServerFakeLog(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, rootClient api.LogClient, nobodyClient api.LogClient, config *Config){
+		"produce/consume a message to/from log succeeds": testProduceConsume,
+		"produce/consume stream succeeds":                testProduceConsumeStream,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			rootClient, nobodyClient, config, teardown := setupTest(t, func(c *Config) {
+				c.CommitLog = newFakeLog()
+			})
+			defer teardown()
+			fn(t, rootClient, nobodyClient, config)
+		})
+	}
+}
+
+// a log kept in memory serves like one on disk
+func TestServerMemFS(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, rootClient api.LogClient, nobodyClient api.LogClient, config *Config){
+		"produce/consume a message to/from log succeeds": testProduceConsume,
+		"consume past log boundary fails":                testConsumePastBoundary,
+		"produce/consume stream succeeds":                testProduceConsumeStream,
+		"produce batch succeeds":                         testProduceBatch,
+		"get log info succeeds":                          testGetLogInfo,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			rootClient, nobodyClient, config, teardown := setupTest(t, func(c *Config) {
+				clog, err := log.NewLog("server-test", log.Config{FS: log.NewMemFS()})
+				require.NoError(t, err)
+				t.Cleanup(func() { clog.Close() })
+				c.CommitLog = NewCommitLog(clog)
+			})
+			defer teardown()
+			fn(t, rootClient, nobodyClient, config)
+		})
+	}
+}
+
+// a CommitLog held in a slice
+type fakeLog struct {
+	mu      sync.Mutex
+	records []*api.Record
+	// closed, and replaced, whenever records are appended
+	appended chan struct{}
+}
+
+func newFakeLog() *fakeLog {
+	return &fakeLog{appended: make(chan struct{})}
+}
+
+func (l *fakeLog) Append(record *api.Record) (uint64, error) {
+	record.Timestamp = time.Now().UnixNano()
+	return l.Replicate(record)
+}
+
+func (l *fakeLog) Replicate(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record.Offset = uint64(len(l.records))
+	l.records = append(l.records, record)
+	close(l.appended)
+	l.appended = make(chan struct{})
+	return record.Offset, nil
+}
+
+func (l *fakeLog) AppendBatch(records []*api.Record) (uint64, uint64, error) {
+	var first, last uint64
+	for i, record := range records {
+		offset, err := l.Append(record)
+		if err != nil {
+			return 0, 0, err
+		}
+		if i == 0 {
+			first = offset
+		}
+		last = offset
+	}
+	return first, last, nil
+}
+
+// returns the record at offset, or a channel closed once it's appended
+func (l *fakeLog) read(offset uint64) (*api.Record, chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset >= uint64(len(l.records)) {
+		return nil, l.appended
+	}
+	return l.records[offset], nil
+}
+
+func (l *fakeLog) Read(offset uint64) (*api.Record, error) {
+	record, _ := l.read(offset)
+	if record == nil {
+		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	return record, nil
+}
+
+func (l *fakeLog) OffsetForTime(ts time.Time) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, record := range l.records {
+		if record.Timestamp >= ts.UnixNano() {
+			return record.Offset, nil
+		}
+	}
+	return uint64(len(l.records)), nil
+}
+
+func (l *fakeLog) Iterator(from uint64) Iterator {
+	return &fakeIterator{log: l, offset: from, closed: make(chan struct{})}
+}
+
+func (l *fakeLog) LogInfo() (*api.GetLogInfoResponse, error) {
+	return &api.GetLogInfoResponse{}, nil
+}
+
+type fakeIterator struct {
+	log    *fakeLog
+	offset uint64
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (it *fakeIterator) Next() (*api.Record, error) {
+	for {
+		record, appended := it.log.read(it.offset)
+		if record != nil {
+			it.offset++
+			return record, nil
+		}
+		select {
+		case <-it.closed:
+			return nil, io.EOF
+		case <-appended:
+		}
+	}
+}
+
+func (it *fakeIterator) Close() error {
+	it.once.Do(func() { close(it.closed) })
+	return nil
+}